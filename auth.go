@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// tokenEnv is the environment variable giving the authentication token
+const tokenEnv = "DELVEAPPENGINE_TOKEN"
+
+// loadToken returns the token the clients must authenticate with: the given
+// one, else the one of the environment, else the one of the token file, which
+// is generated if it doesn't exist. An empty token disables the authentication.
+func loadToken(token string, tokenFile string) (string, error) {
+	if len(token) > 0 {
+		return token, nil
+	}
+	if token = os.Getenv(tokenEnv); len(token) > 0 {
+		return token, nil
+	}
+	if len(tokenFile) == 0 {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadFile(tokenFile)
+	if err == nil {
+		if token = strings.TrimSpace(string(data)); len(token) > 0 {
+			return token, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(random)
+	if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Printf("Generated an authentication token in %s\n", tokenFile)
+	return token, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"debug/gosym"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/derekparker/delve/proc"
+	"github.com/derekparker/delve/service/api"
+	"github.com/derekparker/delve/service/debugger"
+)
+
+// snapshotTimeout is how long we wait for the debugger to release the process
+// to read the breakpoints
+const snapshotTimeout = 2 * time.Second
+
+// snapshotBreakpoints returns the user breakpoints currently set on the debugger.
+// The boolean is false if there is no debugger to read the breakpoints from.
+func snapshotBreakpoints(d *debugger.Debugger) ([]*api.Breakpoint, bool) {
+	bps, ok := readBreakpoints(d)
+	if !ok {
+		return nil, false
+	}
+
+	result := []*api.Breakpoint{}
+	for _, bp := range bps {
+		if bp.ID < 0 { // internal breakpoints
+			continue
+		}
+		result = append(result, bp)
+	}
+	return result, true
+}
+
+// clearBreakpoints removes the breakpoints of the user and returns their
+// number, for the log of the shutdown. The internal and temporary ones are left
+// to the detach, which clears every breakpoint of the process.
+func clearBreakpoints(d *debugger.Debugger) int {
+	bps, ok := snapshotBreakpoints(d)
+	if !ok {
+		return 0
+	}
+	cleared := 0
+	for _, bp := range bps {
+		if _, err := d.ClearBreakpoint(bp); err != nil {
+			log.Printf("Couldn't remove breakpoint %s: %s\n", describeBreakpoint(bp), err)
+			continue
+		}
+		cleared++
+	}
+	return cleared
+}
+
+// readBreakpoints returns all the breakpoints set on the debugger, halting the
+// process first if it is running. The boolean is false if they can't be read.
+func readBreakpoints(d *debugger.Debugger) ([]*api.Breakpoint, bool) {
+	if d == nil {
+		return nil, false
+	}
+
+	// The debugger is locked while the process runs (continued by a client
+	// or after attach): halt it to read the breakpoints.
+	if state, err := d.State(); err == nil && state.Running {
+		log.Println("Halting the module process to read its breakpoints.")
+		go d.Command(&api.DebuggerCommand{Name: api.Halt})
+	}
+
+	bpChan := make(chan []*api.Breakpoint, 1)
+	go func() {
+		bpChan <- d.Breakpoints()
+	}()
+
+	var bps []*api.Breakpoint
+	select {
+	case bps = <-bpChan:
+	case <-time.After(snapshotTimeout):
+		log.Println("Couldn't read the breakpoints of the module process.")
+		return nil, false
+	}
+	return bps, true
+}
+
+// restoreBreakpoints re-creates the breakpoints on the debugger, matching them by file:line
+// and falling back on the function name. Breakpoints that can't be resolved are reported.
+func restoreBreakpoints(d *debugger.Debugger, bps []*api.Breakpoint) {
+	if d == nil {
+		return
+	}
+	restored := 0
+	for _, bp := range bps {
+		if _, err := createBreakpoint(d, bp); err != nil {
+			if !isAlreadySet(err) {
+				log.Printf("Couldn't restore breakpoint %s: %s\n", describeBreakpoint(bp), err)
+			}
+			continue
+		}
+		restored++
+	}
+	if len(bps) > 0 {
+		log.Printf("%d breakpoint(s) carried over to the new process.\n", restored)
+	}
+}
+
+// isAlreadySet returns true if the breakpoint creation failed because it is
+// already set, for example by the init file
+func isAlreadySet(err error) bool {
+	if _, ok := err.(proc.BreakpointExistsError); ok {
+		return true
+	}
+	return err.Error() == "breakpoint name already exists"
+}
+
+// isUnresolvedLocation returns true if the breakpoint creation failed because
+// its file or line is not in the binary anymore
+func isUnresolvedLocation(err error) bool {
+	switch err.(type) {
+	case gosym.UnknownFileError, *gosym.UnknownLineError:
+		return true
+	}
+	return false
+}
+
+// createBreakpoint creates a copy of the breakpoint on the debugger
+func createBreakpoint(d *debugger.Debugger, bp *api.Breakpoint) (*api.Breakpoint, error) {
+	requested := &api.Breakpoint{
+		Name:       bp.Name,
+		File:       bp.File,
+		Line:       bp.Line,
+		Cond:       bp.Cond,
+		Tracepoint: bp.Tracepoint,
+		Goroutine:  bp.Goroutine,
+		Stacktrace: bp.Stacktrace,
+		Variables:  bp.Variables,
+		LoadArgs:   bp.LoadArgs,
+		LoadLocals: bp.LoadLocals,
+	}
+
+	var err error
+	if len(requested.File) > 0 {
+		var created *api.Breakpoint
+		if created, err = d.CreateBreakpoint(requested); err == nil {
+			return created, nil
+		}
+		// only a line that doesn't resolve moves to the function entry
+		if isAlreadySet(err) || !isUnresolvedLocation(err) {
+			return nil, err
+		}
+	}
+	if len(bp.FunctionName) == 0 {
+		return nil, err
+	}
+
+	// the line doesn't resolve anymore, try the function entry
+	requested.File = ""
+	requested.FunctionName = bp.FunctionName
+	requested.Line = -1
+	created, errFunc := d.CreateBreakpoint(requested)
+	if errFunc != nil {
+		return nil, errFunc
+	}
+	if err != nil {
+		log.Printf("Breakpoint %s moved to the entry of %s\n", describeBreakpoint(bp), bp.FunctionName)
+	}
+	return created, nil
+}
+
+func describeBreakpoint(bp *api.Breakpoint) string {
+	desc := bp.FunctionName
+	if len(bp.File) > 0 {
+		desc = fmt.Sprintf("%s:%d", bp.File, bp.Line)
+	}
+	if len(bp.Name) > 0 {
+		desc = bp.Name + " (" + desc + ")"
+	}
+	return desc
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"debug/gosym"
+	"errors"
+	"testing"
+
+	"github.com/derekparker/delve/proc"
+)
+
+func TestBreakpointErrors(t *testing.T) {
+	tests := []struct {
+		err        error
+		set        bool
+		unresolved bool
+	}{
+		{proc.BreakpointExistsError{}, true, false},
+		{errors.New("breakpoint name already exists"), true, false},
+		{gosym.UnknownFileError("main.go"), false, true},
+		{&gosym.UnknownLineError{File: "main.go", Line: 42}, false, true},
+		// a condition that doesn't parse must not move the breakpoint
+		{errors.New("1:3: expected operand"), false, false},
+	}
+	for _, test := range tests {
+		if isAlreadySet(test.err) != test.set {
+			t.Errorf("isAlreadySet(%#v) = %v, want %v", test.err, !test.set, test.set)
+		}
+		if isUnresolvedLocation(test.err) != test.unresolved {
+			t.Errorf("isUnresolvedLocation(%#v) = %v, want %v", test.err, !test.unresolved, test.unresolved)
+		}
+	}
+}
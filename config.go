@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFileName is looked up in the project (working) directory when -config is not given
+const configFileName = "delveappengine.yml"
+
+// Config is the content of the delveAppengine configuration file
+type Config struct {
+	Scan       ScanConfig     `yaml:"scan"`
+	Proxy      *bool          `yaml:"proxy"`
+	StatusAddr string         `yaml:"statusAddr"`
+	TokenFile  string         `yaml:"tokenFile"`
+	TLS        *TLSConfig     `yaml:"tls"`
+	Discovery  string         `yaml:"discovery"`
+	VSCode     bool           `yaml:"vscode"`
+	Hooks      HooksConfig    `yaml:"hooks"`
+	Targets    []TargetConfig `yaml:"targets"`
+
+	path string
+}
+
+// ScanConfig configures the scan of the module processes
+type ScanConfig struct {
+	// Delay in seconds between each scan
+	Delay int `yaml:"delay"`
+	// Events uses the process events instead of polling when available
+	Events *bool `yaml:"events"`
+}
+
+// HooksConfig are the commands run on the attach and detach events
+type HooksConfig struct {
+	// OnAttach is a shell command run after each attach, see -on-attach
+	OnAttach string `yaml:"onAttach"`
+	// OnDetach is a shell command run after each detach, see -on-detach
+	OnDetach string `yaml:"onDetach"`
+	// Timeout is the time a hook may run before it is killed
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// TLSConfig enables TLS on the ports of the Delve servers
+type TLSConfig struct {
+	// Cert and Key are the PEM files of the server certificate, a self-signed
+	// certificate is generated when they are not set
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA is a PEM file of CAs, the clients must present a certificate signed by one of them
+	ClientCA string `yaml:"clientCA"`
+}
+
+// TargetConfig describes a module to debug
+type TargetConfig struct {
+	// Executable is a regexp on the executable name of the module process
+	Executable string `yaml:"executable"`
+	// Match is a process matcher expression, see ParseMatcher
+	Match string `yaml:"match"`
+	// Key identifies the module by name/version or magic key in the binary
+	Key string `yaml:"key"`
+	// Module selects the module by name or name:version
+	Module string `yaml:"module"`
+	// Port of the Delve server, assigned from -port upward when not set, or
+	// selected by the system with -port 0
+	Port int `yaml:"port"`
+	// Listen is the host (or host:port) the Delve server listens on, or
+	// unix:/path/to/socket, 127.0.0.1 when not set
+	Listen string `yaml:"listen"`
+	// APIVersion is the Delve API version served by default
+	APIVersion int `yaml:"apiVersion"`
+	// Init is a file of breakpoints to set on each attached process
+	Init string `yaml:"init"`
+	// Continue resumes the process after attach, true when not set
+	Continue *bool `yaml:"continue"`
+	// Instances is the instance policy: youngest, oldest, all or index=N, see -instances
+	Instances string `yaml:"instances"`
+	// Lazy attaches the process only when a client connects
+	Lazy bool `yaml:"lazy"`
+	// IdleDetach detaches in lazy mode when no client is connected for that long
+	IdleDetach time.Duration `yaml:"idleDetach"`
+	// Early stops the module processes at exec to debug their initialization, see -early
+	Early bool `yaml:"early"`
+}
+
+// loadConfig reads the configuration file. Without path the file is looked up
+// in the working directory and a missing file is not an error: nil is returned.
+func loadConfig(path string) (*Config, error) {
+	explicit := len(path) > 0
+	if !explicit {
+		path = configFileName
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !explicit && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	cfg := &Config{path: path}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	// yaml.v2 ignores the unknown keys, a typo would be silently lost
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := checkKeys(raw, reflect.TypeOf(cfg), ""); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// checkKeys rejects the keys of a decoded YAML node that the type doesn't
+// define in its yaml tags, in the nested structures and lists too. path
+// locates the node in the errors.
+func checkKeys(node interface{}, typ reflect.Type, path string) error {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		values, ok := node.(map[interface{}]interface{})
+		if !ok {
+			// the type mismatches are reported by yaml.Unmarshal
+			return nil
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if name := strings.Split(field.Tag.Get("yaml"), ",")[0]; len(name) > 0 && name != "-" {
+				fields[name] = field.Type
+			}
+		}
+		byName := map[string]interface{}{}
+		keys := make([]string, 0, len(values))
+		for key, value := range values {
+			byName[fmt.Sprint(key)] = value
+			keys = append(keys, fmt.Sprint(key))
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldType, ok := fields[key]
+			if !ok {
+				if len(path) == 0 {
+					return fmt.Errorf("unknown key %q", key)
+				}
+				return fmt.Errorf("%s: unknown key %q", path, key)
+			}
+			sub := key
+			if len(path) > 0 {
+				sub = path + "." + key
+			}
+			if err := checkKeys(byName[key], fieldType, sub); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		items, _ := node.([]interface{})
+		for i, item := range items {
+			if err := checkKeys(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the values of the configuration file
+func (c *Config) validate() error {
+	if c.Scan.Delay < 0 {
+		return fmt.Errorf("scan.delay must be positive, got %d", c.Scan.Delay)
+	}
+	if c.Hooks.Timeout < 0 {
+		return fmt.Errorf("hooks.timeout must be positive, got %s", c.Hooks.Timeout)
+	}
+	ports := map[int]int{}
+	for i, t := range c.Targets {
+		if len(t.Executable) > 0 {
+			if _, err := regexp.Compile(t.Executable); err != nil {
+				return fmt.Errorf("targets[%d].executable: %s", i, err)
+			}
+		}
+		if len(t.Match) > 0 {
+			if _, err := ParseMatcher(t.Match); err != nil {
+				return fmt.Errorf("targets[%d].match: %s", i, err)
+			}
+		}
+		if len(c.Targets) > 1 && len(t.Key) == 0 && len(t.Module) == 0 {
+			return fmt.Errorf("targets[%d]: a key or a module is needed to tell the targets apart", i)
+		}
+		if len(t.Instances) > 0 {
+			if _, err := parseInstancePolicy(t.Instances); err != nil {
+				return fmt.Errorf("targets[%d].instances: %s", i, err)
+			}
+		}
+		if len(t.Listen) > 0 {
+			if _, err := parseListen(t.Listen); err != nil {
+				return fmt.Errorf("targets[%d].listen: %s", i, err)
+			}
+		}
+		if t.Port < 0 || t.Port > 65535 {
+			return fmt.Errorf("targets[%d].port: invalid port %d", i, t.Port)
+		}
+		if t.Port > 0 {
+			if j, ok := ports[t.Port]; ok {
+				return fmt.Errorf("targets[%d].port: port %d already used by targets[%d]", i, t.Port, j)
+			}
+			ports[t.Port] = i
+		}
+		if t.APIVersion < 0 || t.APIVersion > 2 {
+			return fmt.Errorf("targets[%d].apiVersion: unknown API version %d", i, t.APIVersion)
+		}
+		if len(t.Init) > 0 {
+			if _, err := os.Stat(c.resolve(t.Init)); err != nil {
+				return fmt.Errorf("targets[%d].init: %s", i, err)
+			}
+		}
+		if t.IdleDetach < 0 {
+			return fmt.Errorf("targets[%d].idleDetach: invalid duration %s", i, t.IdleDetach)
+		}
+		if t.Early && t.Lazy {
+			return fmt.Errorf("targets[%d]: early and lazy can't be both set", i)
+		}
+	}
+	return nil
+}
+
+// resolve returns the path relative to the directory of the configuration file
+func (c *Config) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(c.path), path)
+}
+
+// buildTargets builds the targets described by the configuration file. The
+// key, module and port set on the command line override the file values of a single target.
+func (c *Config) buildTargets(setFlags map[string]bool, key string, module string, port int) ([]*target, error) {
+	// -port 0 auto-selects the ports of all the targets
+	overridePort := setFlags["port"] && port > 0
+	if setFlags["key"] || setFlags["module"] || overridePort {
+		if len(c.Targets) > 1 {
+			return nil, errors.New("-key, -module and -port can't override several targets, use -targets")
+		}
+	}
+
+	targetConfigs := c.Targets
+	if len(targetConfigs) == 0 {
+		targetConfigs = []TargetConfig{{}}
+	}
+
+	targets := []*target{}
+	used := map[int]bool{}
+	for _, tc := range targetConfigs {
+		used[tc.Port] = true
+	}
+	nextPort := port
+	for _, tc := range targetConfigs {
+		if setFlags["key"] || len(tc.Key) == 0 {
+			tc.Key = key
+		}
+		if setFlags["module"] || len(tc.Module) == 0 {
+			tc.Module = module
+		}
+		if overridePort {
+			tc.Port = port
+		}
+		if tc.Port == 0 && nextPort > 0 {
+			for used[nextPort] {
+				nextPort++
+			}
+			tc.Port = nextPort
+			used[nextPort] = true
+		}
+
+		if strings.HasPrefix(tc.Listen, unixPrefix) {
+			tc.Listen = unixPrefix + c.resolve(strings.TrimPrefix(tc.Listen, unixPrefix))
+		}
+		if setFlags["init"] {
+			tc.Init = initFile
+		} else if len(tc.Init) > 0 {
+			tc.Init = c.resolve(tc.Init)
+		}
+
+		t := newTarget(tc.Key, tc.Module, tc.Port)
+		if err := t.configure(tc); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// configure applies the settings of the configuration file to the target
+func (t *target) configure(tc TargetConfig) error {
+	matchers := AllMatcher{}
+	if len(tc.Executable) > 0 {
+		re, err := regexp.Compile(tc.Executable)
+		if err != nil {
+			return err
+		}
+		matchers = append(matchers, NameRegexpMatcher{Regexp: re})
+	}
+	if len(tc.Match) > 0 {
+		m, err := ParseMatcher(tc.Match)
+		if err != nil {
+			return err
+		}
+		matchers = append(matchers, m)
+	}
+	switch len(matchers) {
+	case 0:
+	case 1:
+		t.matcher = matchers[0]
+	default:
+		t.matcher = matchers
+	}
+	if len(tc.Listen) > 0 {
+		addr, err := parseListen(tc.Listen)
+		if err != nil {
+			return err
+		}
+		t.setListen(addr)
+	}
+	t.apiVersion = tc.APIVersion
+	t.autoContinue = tc.Continue == nil || *tc.Continue
+	t.initFile = tc.Init
+	t.lazy = tc.Lazy
+	t.idleTimeout = tc.IdleDetach
+	t.early = tc.Early
+	if len(tc.Instances) > 0 {
+		policy, err := parseInstancePolicy(tc.Instances)
+		if err != nil {
+			return err
+		}
+		t.policy = policy
+	}
+	return nil
+}
+
+// applySettings sets the global settings of the configuration file that are not set on the command line
+func (c *Config) applySettings(setFlags map[string]bool) {
+	if !setFlags["delay"] && c.Scan.Delay > 0 {
+		delaySeconds = c.Scan.Delay
+	}
+	if !setFlags["events"] && c.Scan.Events != nil {
+		useProcessEvents = *c.Scan.Events
+	}
+	if !setFlags["proxy"] && c.Proxy != nil {
+		useProxy = *c.Proxy
+	}
+	if !setFlags["status-addr"] && len(c.StatusAddr) > 0 {
+		statusAddr = c.StatusAddr
+	}
+	if !setFlags["token-file"] && len(c.TokenFile) > 0 {
+		tokenFile = c.resolve(c.TokenFile)
+	}
+	if !setFlags["discovery"] && len(c.Discovery) > 0 {
+		discoveryPath = c.resolve(c.Discovery)
+	}
+	if !setFlags["vscode"] && c.VSCode {
+		updateVSCode = true
+	}
+	if !setFlags["on-attach"] && len(c.Hooks.OnAttach) > 0 {
+		hooks.onAttach = c.Hooks.OnAttach
+	}
+	if !setFlags["on-detach"] && len(c.Hooks.OnDetach) > 0 {
+		hooks.onDetach = c.Hooks.OnDetach
+	}
+	if !setFlags["hook-timeout"] && c.Hooks.Timeout != 0 {
+		hooks.timeout = c.Hooks.Timeout
+	}
+	if !setFlags["tls"] && c.TLS != nil {
+		useTLS = true
+	}
+	if c.TLS != nil {
+		if !setFlags["tls-cert"] && len(c.TLS.Cert) > 0 {
+			tlsSettings.Cert = c.resolve(c.TLS.Cert)
+		}
+		if !setFlags["tls-key"] && len(c.TLS.Key) > 0 {
+			tlsSettings.Key = c.resolve(c.TLS.Key)
+		}
+		if !setFlags["tls-client-ca"] && len(c.TLS.ClientCA) > 0 {
+			tlsSettings.ClientCA = c.resolve(c.TLS.ClientCA)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := &Config{Targets: []TargetConfig{
+		{Key: "frontend", Port: 2345, Match: "name:app && cmdline:--port=8080", Instances: "index=1"},
+		{Module: "worker:v2", Port: 2346, Listen: "unix:/tmp/worker.sock", APIVersion: 2},
+		{Key: "admin"},
+	}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("valid configuration: %s", err)
+	}
+
+	tests := []struct {
+		config *Config
+		err    string
+	}{
+		{&Config{Scan: ScanConfig{Delay: -1}}, "scan.delay"},
+		{&Config{Hooks: HooksConfig{Timeout: -1}}, "hooks.timeout"},
+		{&Config{Targets: []TargetConfig{{Executable: "("}}}, "targets[0].executable"},
+		{&Config{Targets: []TargetConfig{{Match: "name="}}}, "targets[0].match"},
+		{&Config{Targets: []TargetConfig{{Key: "a"}, {}}}, "targets[1]: a key or a module"},
+		{&Config{Targets: []TargetConfig{{Instances: "newest"}}}, "targets[0].instances"},
+		{&Config{Targets: []TargetConfig{{Listen: "unix:"}}}, "targets[0].listen"},
+		{&Config{Targets: []TargetConfig{{Port: 70000}}}, "targets[0].port"},
+		{&Config{Targets: []TargetConfig{{Key: "a", Port: 2345}, {Key: "b", Port: 2345}}}, "port 2345 already used by targets[0]"},
+		{&Config{Targets: []TargetConfig{{APIVersion: 3}}}, "targets[0].apiVersion"},
+		{&Config{Targets: []TargetConfig{{Init: "missing.init"}}}, "targets[0].init"},
+		{&Config{Targets: []TargetConfig{{IdleDetach: -1}}}, "targets[0].idleDetach"},
+		{&Config{Targets: []TargetConfig{{Early: true, Lazy: true}}}, "early and lazy"},
+	}
+	for i, test := range tests {
+		err := test.config.validate()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("test %d: validate = %v, want an error about %s", i, err, test.err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delveappengine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the init file is relative to the configuration file
+	if err := ioutil.WriteFile(filepath.Join(dir, "frontend.init"), []byte("break main.main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, configFileName)
+	data := `
+scan:
+  delay: 2
+targets:
+  - key: frontend
+    port: 3000
+    init: frontend.init
+  - module: worker
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Scan.Delay != 2 || len(cfg.Targets) != 2 || cfg.Targets[0].Port != 3000 || cfg.Targets[1].Module != "worker" {
+		t.Errorf("loaded %+v", cfg)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("targets:\n  - apiVersion: 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("invalid configuration: %v, want an error naming the file", err)
+	}
+	// the unknown keys are rejected, at any level
+	unknown := []struct {
+		data string
+		err  string
+	}{
+		{"breakpoint: frontend.init\n", `unknown key "breakpoint"`},
+		{"scan:\n  dealy: 2\n", `scan: unknown key "dealy"`},
+		{"tls:\n  certificate: cert.pem\n", `tls: unknown key "certificate"`},
+		{"targets:\n  - key: frontend\n  - key: worker\n    idle_detach: 5m\n", `targets[1]: unknown key "idle_detach"`},
+	}
+	for _, test := range unknown {
+		if err := ioutil.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("loadConfig(%q) = %v, want an error about %s", test.data, err, test.err)
+		}
+	}
+
+	if _, err := loadConfig(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Error("missing explicit configuration file accepted")
+	}
+}
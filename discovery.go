@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultDiscoveryPath is where the discovery file is written when a port is auto-selected
+const defaultDiscoveryPath = ".delveappengine/targets.json"
+
+// launchPath is the VS Code launch configuration updated with -vscode
+const launchPath = ".vscode/launch.json"
+
+// launchNamePrefix starts the names of the launch configurations generated for the targets
+const launchNamePrefix = "delveAppengine "
+
+// discoveryFile is the content of the discovery file: where to connect to debug each module
+type discoveryFile struct {
+	PID     int               `json:"pid"`
+	Updated time.Time         `json:"updated"`
+	Targets []discoveryTarget `json:"targets"`
+}
+
+// discoveryTarget describes the Delve server of a target
+type discoveryTarget struct {
+	Key        string `json:"key"`
+	Module     string `json:"module,omitempty"`
+	State      string `json:"state"`
+	PID        int    `json:"pid,omitempty"`
+	Network    string `json:"network"`
+	Address    string `json:"address"`
+	APIVersion int    `json:"apiVersion"`
+	TLS        bool   `json:"tls"`
+	Token      bool   `json:"tokenRequired"`
+}
+
+// launchConfiguration is a VS Code remote attach configuration of the Go extension
+type launchConfiguration struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Request    string `json:"request"`
+	Mode       string `json:"mode"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	APIVersion int    `json:"apiVersion"`
+}
+
+// discovery keeps the discovery file and the launch configurations up to date
+var discovery = struct {
+	sync.Mutex
+	path    string
+	vscode  bool
+	targets []*target
+	// launched are the last launch configurations written
+	launched []byte
+}{}
+
+var discoveryPath string
+var updateVSCode bool
+
+// startDiscovery sets up the discovery file of the targets: at the -discovery
+// path, or at the default path if a port is auto-selected
+func startDiscovery(targets []*target) {
+	path := discoveryPath
+	if len(path) == 0 {
+		for _, t := range targets {
+			if t.port == 0 && len(t.socket) == 0 {
+				path = defaultDiscoveryPath
+			}
+		}
+	}
+	discovery.Lock()
+	discovery.path = path
+	discovery.vscode = updateVSCode
+	discovery.targets = targets
+	discovery.Unlock()
+}
+
+// publish updates the discovery file and the launch configurations after a
+// change of the target: port selected, attach or detach
+func (t *target) publish() {
+	discovery.Lock()
+	defer discovery.Unlock()
+	if len(discovery.path) == 0 && !discovery.vscode {
+		return
+	}
+
+	file := discoveryFile{PID: os.Getpid(), Updated: time.Now(), Targets: []discoveryTarget{}}
+	var launches []launchConfiguration
+	for _, target := range withInstances(discovery.targets) {
+		status := target.Status()
+		if status.Port == 0 && len(target.socket) == 0 {
+			// not listening yet
+			continue
+		}
+		apiVersion := target.apiVersion
+		if apiVersion < 2 {
+			apiVersion = 1
+		}
+		file.Targets = append(file.Targets, discoveryTarget{
+			Key:        status.Key,
+			Module:     target.module,
+			State:      status.State,
+			PID:        status.AttachedPID,
+			Network:    target.network(),
+			Address:    status.Listen,
+			APIVersion: apiVersion,
+			TLS:        tlsConfig != nil,
+			Token:      len(authToken) > 0,
+		})
+		if target.network() == "tcp" {
+			launches = append(launches, launchConfiguration{
+				Name:       launchNamePrefix + target.name(),
+				Type:       "go",
+				Request:    "attach",
+				Mode:       "remote",
+				Host:       connectHost(target.host),
+				Port:       status.Port,
+				APIVersion: apiVersion,
+			})
+		}
+	}
+
+	if len(discovery.path) > 0 {
+		if data, err := json.MarshalIndent(file, "", "  "); err != nil {
+			log.Printf("Couldn't encode the discovery file: %s\n", err)
+		} else if err := writeFileAtomic(discovery.path, append(data, '\n')); err != nil {
+			log.Printf("Couldn't write the discovery file: %s\n", err)
+		}
+	}
+	if discovery.vscode {
+		updateLaunchConfigurations(launches)
+	}
+}
+
+// stopDiscovery removes the discovery file, the Delve servers are gone
+func stopDiscovery() {
+	discovery.Lock()
+	defer discovery.Unlock()
+	if len(discovery.path) > 0 {
+		if err := os.Remove(discovery.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Couldn't remove the discovery file: %s\n", err)
+		}
+		discovery.path = ""
+	}
+	discovery.vscode = false
+}
+
+// name is the name of the target in the launch configurations and the status
+// API, followed by #index for the other instances of the all policy
+func (t *target) name() string {
+	name := "module"
+	switch {
+	case len(t.key) > 0:
+		name = t.key
+	case len(t.module) > 0:
+		name = t.module
+	}
+	if t.parent != nil {
+		name = fmt.Sprintf("%s#%d", name, t.policy.index)
+	}
+	return name
+}
+
+// connectHost returns the host a client connects to for a listen host
+func connectHost(host string) string {
+	switch host {
+	case "", "0.0.0.0":
+		return "127.0.0.1"
+	case "::":
+		return "::1"
+	}
+	return host
+}
+
+// updateLaunchConfigurations replaces the launch configurations of the targets
+// in the VS Code launch file, keeping the other ones. It is only rewritten when
+// the configurations of the targets change.
+func updateLaunchConfigurations(launches []launchConfiguration) {
+	generated, err := json.Marshal(launches)
+	if err != nil || bytes.Equal(generated, discovery.launched) {
+		return
+	}
+
+	// pointers to the raw messages: before Go 1.8 RawMessage.MarshalJSON has a
+	// pointer receiver, the values of a map would be encoded in base64
+	launch := map[string]*json.RawMessage{}
+	var configurations []*json.RawMessage
+	data, err := ioutil.ReadFile(launchPath)
+	switch {
+	case os.IsNotExist(err):
+		version := json.RawMessage(`"0.2.0"`)
+		launch["version"] = &version
+	case err != nil:
+		log.Printf("Couldn't read %s: %s\n", launchPath, err)
+		return
+	default:
+		if err := json.Unmarshal(data, &launch); err != nil {
+			log.Printf("Not updating %s, it is not plain JSON (comments?): %s\n", launchPath, err)
+			return
+		}
+		if raw, ok := launch["configurations"]; ok && raw != nil {
+			if err := json.Unmarshal(*raw, &configurations); err != nil {
+				log.Printf("Not updating %s: invalid configurations: %s\n", launchPath, err)
+				return
+			}
+		}
+	}
+
+	replaced := map[string]bool{}
+	for _, l := range launches {
+		replaced[l.Name] = true
+	}
+	kept := []*json.RawMessage{}
+	for _, c := range configurations {
+		var named struct{ Name string }
+		if c != nil && json.Unmarshal(*c, &named) == nil && replaced[named.Name] {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	for _, l := range launches {
+		c, _ := json.Marshal(l)
+		raw := json.RawMessage(c)
+		kept = append(kept, &raw)
+	}
+	all, _ := json.Marshal(kept)
+	raw := json.RawMessage(all)
+	launch["configurations"] = &raw
+
+	data, err = json.MarshalIndent(launch, "", "    ")
+	if err == nil {
+		err = writeFileAtomic(launchPath, append(data, '\n'))
+	}
+	if err != nil {
+		log.Printf("Couldn't update %s: %s\n", launchPath, err)
+		return
+	}
+	discovery.launched = generated
+	log.Printf("Updated %s with %d launch configurations\n", launchPath, len(launches))
+}
+
+// writeFileAtomic writes the file through a temporary file, so that readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// resolvePort records the port selected by the system for a target listening on port 0
+func (t *target) resolvePort(listener net.Listener) {
+	if t.port != 0 || len(t.socket) > 0 {
+		return
+	}
+	_, portStr, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return
+	}
+	selected, _ := strconv.Atoi(portStr)
+	t.mu.Lock()
+	t.port = selected
+	t.autoPort = true
+	t.mu.Unlock()
+	log.Printf("Target %s: listening on the auto-selected port %d\n", t, selected)
+}
+
+// selectPort picks a free port for a target listening on port 0 that doesn't
+// keep its listener between two attaches
+func (t *target) selectPort() error {
+	if t.port != 0 || len(t.socket) > 0 {
+		return nil
+	}
+	listener, err := listen(t.network(), t.addr())
+	if err != nil {
+		return err
+	}
+	t.resolvePort(listener)
+	listener.Close()
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateLaunchConfigurations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delveappengine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer func() { discovery.launched = nil }()
+
+	existing := `{
+    "version": "0.2.0",
+    "configurations": [
+        {"name": "Launch", "type": "go", "request": "launch", "program": "${workspaceRoot}"},
+        {"name": "delveAppengine frontend", "type": "go", "request": "launch", "mode": "remote", "port": 2345}
+    ],
+    "compounds": [{"name": "All", "configurations": ["Launch"]}]
+}`
+	if err := os.MkdirAll(filepath.Dir(launchPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(launchPath, []byte(existing), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	frontend := launchConfiguration{Name: "delveAppengine frontend", Type: "go", Request: "launch", Mode: "remote", Host: "127.0.0.1", Port: 3000, APIVersion: 2}
+	updateLaunchConfigurations([]launchConfiguration{frontend})
+
+	data, err := ioutil.ReadFile(launchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var launch struct {
+		Version        string
+		Configurations []map[string]interface{}
+		Compounds      []map[string]interface{}
+	}
+	if err := json.Unmarshal(data, &launch); err != nil {
+		t.Fatalf("invalid launch file: %s\n%s", err, data)
+	}
+	if launch.Version != "0.2.0" || len(launch.Compounds) != 1 {
+		t.Errorf("the other entries of the launch file are not kept:\n%s", data)
+	}
+	if len(launch.Configurations) != 2 {
+		t.Fatalf("configurations %v, want the user one and the one of the target", launch.Configurations)
+	}
+	user := map[string]interface{}{"name": "Launch", "type": "go", "request": "launch", "program": "${workspaceRoot}"}
+	if !reflect.DeepEqual(launch.Configurations[0], user) {
+		t.Errorf("user configuration %v, want it unchanged", launch.Configurations[0])
+	}
+	if c := launch.Configurations[1]; c["name"] != frontend.Name || c["port"] != float64(3000) || c["host"] != "127.0.0.1" {
+		t.Errorf("target configuration %v", c)
+	}
+
+	// a new launch file
+	os.Remove(launchPath)
+	discovery.launched = nil
+	updateLaunchConfigurations([]launchConfiguration{frontend})
+	data, err = ioutil.ReadFile(launchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	launch.Configurations = nil
+	if err := json.Unmarshal(data, &launch); err != nil || launch.Version != "0.2.0" || len(launch.Configurations) != 1 {
+		t.Errorf("new launch file: %v\n%s", err, data)
+	}
+}
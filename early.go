@@ -0,0 +1,250 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/derekparker/delve/service/api"
+	"github.com/derekparker/delve/service/debugger"
+)
+
+// maxHold is the time a process stopped at exec waits for its target to
+// attach it, it is resumed after that
+const maxHold = 10 * time.Second
+
+// earlyPollInterval is the delay between two polls of the new processes when
+// the process events are unavailable
+const earlyPollInterval = 20 * time.Millisecond
+
+// earlyPollChecks is the number of polls a new process is checked for, to
+// give it the time to exec the module binary after the fork
+const earlyPollChecks = 50
+
+// initFunctions are the functions the process caught at exec is stopped at,
+// by order of preference: they run before main.main
+var initFunctions = []string{"main.init", "runtime.main"}
+
+// held are the processes stopped at exec until their target attaches them,
+// caught are the processes ever stopped, a process is only stopped once
+var held = struct {
+	sync.Mutex
+	m      map[int]ProcessIdentity
+	caught map[int]ProcessIdentity
+}{m: map[int]ProcessIdentity{}, caught: map[int]ProcessIdentity{}}
+
+// holdProcess stops the process that just exec'd, so that it doesn't run its
+// initialization before its target attaches it
+func holdProcess(id ProcessIdentity) {
+	held.Lock()
+	defer held.Unlock()
+	if caught, ok := held.caught[id.Pid]; ok && caught.Same(id) {
+		return
+	}
+	if err := syscall.Kill(id.Pid, syscall.SIGSTOP); err != nil {
+		return
+	}
+	held.m[id.Pid] = id
+	held.caught[id.Pid] = id
+	log.Printf("Early attach: stopped %s at exec\n", id)
+	time.AfterFunc(maxHold, func() { releaseHeld(id, "no target attached it") })
+}
+
+// claimHeld returns true if the process was stopped at exec, its target is
+// attaching it and the process is resumed by the debugger
+func claimHeld(id ProcessIdentity) bool {
+	held.Lock()
+	defer held.Unlock()
+	h, ok := held.m[id.Pid]
+	if !ok || !h.Same(id) {
+		return false
+	}
+	delete(held.m, id.Pid)
+	return true
+}
+
+// releaseHeld resumes the process if it is still stopped at exec
+func releaseHeld(id ProcessIdentity, reason string) {
+	held.Lock()
+	defer held.Unlock()
+	if h, ok := held.m[id.Pid]; !ok || !h.Same(id) {
+		return
+	}
+	delete(held.m, id.Pid)
+	resumeHeld(id, reason)
+}
+
+// resumeHeld resumes the process stopped at exec, when its target claimed it
+// but couldn't attach it
+func resumeHeld(id ProcessIdentity, reason string) {
+	syscall.Kill(id.Pid, syscall.SIGCONT)
+	log.Printf("Early attach: resumed %s, %s\n", id, reason)
+}
+
+// releaseAllHeld resumes the processes stopped at exec, on shutdown
+func releaseAllHeld() {
+	held.Lock()
+	ids := []ProcessIdentity{}
+	for _, id := range held.m {
+		ids = append(ids, id)
+	}
+	held.Unlock()
+	for _, id := range ids {
+		releaseHeld(id, "shutting down")
+	}
+}
+
+// watchExecs stops the module processes of the early targets as soon as they
+// exec, and asks for a scan to attach them. The execs are reported by the
+// process events, or by a tight poll of the new processes.
+func watchExecs(targets []*target, scan chan<- bool, stop <-chan bool) {
+	check := func(pid int) bool {
+		if !isEarlyProcess(targets, pid) {
+			return false
+		}
+		select {
+		case scan <- true:
+		default:
+			// a scan is already asked
+		}
+		return true
+	}
+
+	events, err := watchProcessEvents()
+	if err != nil {
+		log.Printf("Early attach: process events unavailable, polling the new processes every %s: %s\n", earlyPollInterval, err)
+		pollExecs(check, stop)
+		return
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case e, ok := <-events:
+			if !ok {
+				log.Println("Early attach: process events lost, polling the new processes")
+				pollExecs(check, stop)
+				return
+			}
+			if e.Exec {
+				check(e.Pid)
+			}
+		}
+	}
+}
+
+// isEarlyProcess stops the process if it is a module process of an early target
+func isEarlyProcess(targets []*target, pid int) bool {
+	p, err := findProcess(pid)
+	if err != nil || p.Zombie() || tracerPid(pid) != 0 {
+		// a process launched by the wrapper is traced from its exec
+		return false
+	}
+	var info *ModuleInfo
+	for _, t := range targets {
+		if !t.early || !t.isModuleProcess(p) {
+			continue
+		}
+		if info == nil {
+			identified := identifyModule(p)
+			info = &identified
+		}
+		if t.matches(p, *info) {
+			holdProcess(p.Identity())
+			return true
+		}
+	}
+	return false
+}
+
+// pollExecs checks the new processes until stop is closed. A new process is
+// checked again for a while, in case it was caught between its fork and its
+// exec, until check returns true.
+func pollExecs(check func(pid int) bool, stop <-chan bool) {
+	known := map[int]bool{}
+	young := map[int]int{}
+	first := true
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(earlyPollInterval):
+		}
+		pids, err := listPIDs()
+		if err != nil {
+			continue
+		}
+		alive := map[int]bool{}
+		for _, pid := range pids {
+			alive[pid] = true
+			if !known[pid] {
+				known[pid] = true
+				if !first {
+					young[pid] = earlyPollChecks
+				}
+			}
+		}
+		first = false
+		for pid := range known {
+			if !alive[pid] {
+				delete(known, pid)
+				delete(young, pid)
+			}
+		}
+		for pid, checks := range young {
+			if checks == 0 || check(pid) {
+				delete(young, pid)
+				continue
+			}
+			young[pid] = checks - 1
+		}
+	}
+}
+
+// stopAtInit runs the process caught at exec until the initialization of the
+// module, before main.main. It is then continued if breakpoints are set to
+// catch the initialization, and left stopped for a client otherwise.
+func stopAtInit(t *target, d *debugger.Debugger) {
+	pid := d.ProcessPid()
+	var addr uint64
+	var function string
+	for _, function = range initFunctions {
+		var err error
+		if addr, err = d.SetTempBreakpoint(function); err == nil {
+			break
+		}
+	}
+	if addr == 0 {
+		log.Printf("Target %s: no initialization function found in PID %d, leaving it stopped\n", t, pid)
+		return
+	}
+
+	state, err := d.Command(&api.DebuggerCommand{Name: api.Continue})
+	if err != nil {
+		log.Printf("Target %s: couldn't continue PID %d: %s\n", t, pid, err)
+		return
+	}
+	if state.Exited {
+		return
+	}
+	if state.CurrentThread == nil || state.CurrentThread.PC != addr {
+		for _, th := range stoppedThreads(state) {
+			log.Printf("Target %s: PID %d stopped at breakpoint %s before %s\n", t, pid, describeBreakpoint(th.Breakpoint), function)
+		}
+		return
+	}
+
+	breakpoints := 0
+	for _, bp := range d.Breakpoints() {
+		if bp.ID > 0 {
+			breakpoints++
+		}
+	}
+	if breakpoints == 0 {
+		log.Printf("Target %s: PID %d stopped in %s, before main.main, waiting for a client\n", t, pid, function)
+		return
+	}
+	log.Printf("Target %s: PID %d stopped in %s, before main.main, continuing to its %d breakpoints\n", t, pid, function, breakpoints)
+	resumeProcess(t, d)
+}
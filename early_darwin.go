@@ -0,0 +1,13 @@
+// +build darwin
+
+package main
+
+import "errors"
+
+// earlyAttachSupported is false on darwin: the processes can't be caught at exec
+const earlyAttachSupported = false
+
+// listPIDs is not used on darwin, the early attach is not supported
+func listPIDs() ([]int, error) {
+	return nil, errors.New("the early attach is not supported on darwin")
+}
@@ -0,0 +1,31 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// earlyAttachSupported is true when the processes can be caught at exec
+const earlyAttachSupported = true
+
+// listPIDs lists the PIDs of the running processes
+func listPIDs() ([]int, error) {
+	d, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(names))
+	for _, name := range names {
+		if pid, err := strconv.Atoi(name); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,10 @@
+// +build darwin
+
+package main
+
+import "errors"
+
+// watchProcessEvents is not available on darwin, the processes are polled
+func watchProcessEvents() (<-chan processEvent, error) {
+	return nil, errors.New("process events are not supported on darwin")
+}
@@ -0,0 +1,120 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Netlink proc connector constants, see linux/connector.h and linux/cn_proc.h
+const (
+	netlinkConnector = 11 // NETLINK_CONNECTOR
+
+	cnIdxProc = 1 // CN_IDX_PROC
+	cnValProc = 1 // CN_VAL_PROC
+
+	procCnMcastListen = 1 // PROC_CN_MCAST_LISTEN
+
+	procEventExec = 0x00000002 // PROC_EVENT_EXEC
+	procEventExit = 0x80000000 // PROC_EVENT_EXIT
+
+	nlMsgHdrLen = 16 // sizeof(struct nlmsghdr)
+	cnMsgLen    = 20 // sizeof(struct cn_msg)
+	procEvtLen  = 16 // what, cpu and timestamp of struct proc_event
+)
+
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// watchProcessEvents subscribes to the exec and exit events of the kernel proc
+// connector. It fails if the connector is unavailable, for example when we don't
+// have the CAP_NET_ADMIN capability. The channel is closed if the connection is lost.
+func watchProcessEvents() (<-chan processEvent, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM, netlinkConnector)
+	if err != nil {
+		return nil, err
+	}
+
+	// the port ID is left to the kernel: the early attach subscribes a second socket
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: cnIdxProc}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// ask for the events
+	msg := make([]byte, nlMsgHdrLen+cnMsgLen+4)
+	nativeEndian.PutUint32(msg[0:], uint32(len(msg)))      // nlmsg_len
+	nativeEndian.PutUint16(msg[4:], syscall.NLMSG_DONE)    // nlmsg_type
+	nativeEndian.PutUint32(msg[12:], uint32(os.Getpid()))  // nlmsg_pid
+	nativeEndian.PutUint32(msg[nlMsgHdrLen:], cnIdxProc)   // cn_msg.id.idx
+	nativeEndian.PutUint32(msg[nlMsgHdrLen+4:], cnValProc) // cn_msg.id.val
+	nativeEndian.PutUint16(msg[nlMsgHdrLen+16:], 4)        // cn_msg.len
+	nativeEndian.PutUint32(msg[nlMsgHdrLen+cnMsgLen:], procCnMcastListen)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	events := make(chan processEvent, 64)
+	go func() {
+		defer syscall.Close(fd)
+		defer close(events)
+		buf := make([]byte, syscall.Getpagesize())
+		for {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.ENOBUFS {
+				// the socket buffer overflowed, the events in it are lost
+				events <- processEvent{Lost: true}
+				continue
+			}
+			if err != nil {
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				if e, ok := parseProcEvent(m.Data); ok {
+					events <- e
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// parseProcEvent decodes the exec and exit events of the processes, thread events are ignored
+func parseProcEvent(data []byte) (processEvent, bool) {
+	if len(data) < cnMsgLen+procEvtLen+8 {
+		return processEvent{}, false
+	}
+	event := data[cnMsgLen:]
+	pid := int(nativeEndian.Uint32(event[procEvtLen:]))
+	tgid := int(nativeEndian.Uint32(event[procEvtLen+4:]))
+	if pid != tgid {
+		return processEvent{}, false
+	}
+	switch nativeEndian.Uint32(event) {
+	case procEventExec:
+		return processEvent{Pid: pid, Exec: true}, true
+	case procEventExit:
+		return processEvent{Pid: pid, Exec: false}, true
+	}
+	return processEvent{}, false
+}
@@ -0,0 +1,50 @@
+// +build linux
+
+package main
+
+import "testing"
+
+// procEventData builds the payload of a proc connector message
+func procEventData(what uint32, pid int, tgid int) []byte {
+	data := make([]byte, cnMsgLen+procEvtLen+8)
+	event := data[cnMsgLen:]
+	nativeEndian.PutUint32(event, what)
+	nativeEndian.PutUint32(event[procEvtLen:], uint32(pid))
+	nativeEndian.PutUint32(event[procEvtLen+4:], uint32(tgid))
+	return data
+}
+
+func TestParseProcEvent(t *testing.T) {
+	tests := []struct {
+		data  []byte
+		event processEvent
+		ok    bool
+	}{
+		{procEventData(procEventExec, 42, 42), processEvent{Pid: 42, Exec: true}, true},
+		{procEventData(procEventExit, 42, 42), processEvent{Pid: 42}, true},
+		// thread of process 42
+		{procEventData(procEventExit, 43, 42), processEvent{}, false},
+		// fork
+		{procEventData(0x00000001, 42, 42), processEvent{}, false},
+		{procEventData(procEventExec, 42, 42)[:cnMsgLen+procEvtLen], processEvent{}, false},
+		{nil, processEvent{}, false},
+	}
+	for i, test := range tests {
+		event, ok := parseProcEvent(test.data)
+		if ok != test.ok || event != test.event {
+			t.Errorf("test %d: parseProcEvent = %+v, %v, want %+v, %v", i, event, ok, test.event, test.ok)
+		}
+	}
+}
+
+func TestIsModuleProcessEventLost(t *testing.T) {
+	if !isModuleProcessEvent(nil, processEvent{Lost: true}, map[int]bool{}) {
+		t.Error("lost events must trigger a scan")
+	}
+	if isModuleProcessEvent(nil, processEvent{Pid: 42}, map[int]bool{}) {
+		t.Error("the exit of an unknown process must not trigger a scan")
+	}
+	if !isModuleProcessEvent(nil, processEvent{Pid: 42}, map[int]bool{42: true}) {
+		t.Error("the exit of a module process must trigger a scan")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"github.com/derekparker/delve/service/debugger"
+)
+
+// exitPollInterval is the delay between two checks of the attached process
+const exitPollInterval = 1 * time.Second
+
+// processExit reports the exit of an attached process
+type processExit struct {
+	process ProcessIdentity
+	// status is the exit status, nil when the process died while stopped by
+	// the debugger and its status couldn't be collected
+	status *int
+}
+
+// watchExit reports on the exits channel the exit of the attached process: seen
+// by the debugger when the process was running, or found gone (or a zombie)
+// when it died while stopped. Without debugger, for a process launched by the
+// wrapper, only the latter is checked. It returns when done is closed.
+func watchExit(id ProcessIdentity, d *debugger.Debugger, exits chan<- processExit, done <-chan bool) {
+	ticker := time.NewTicker(exitPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		exit, ok := checkExit(id, d)
+		if !ok {
+			continue
+		}
+		select {
+		case exits <- exit:
+		case <-done:
+		}
+		return
+	}
+}
+
+// checkExit returns true if the attached process exited
+func checkExit(id ProcessIdentity, d *debugger.Debugger) (processExit, bool) {
+	if d != nil {
+		if exited, status := d.Exited(); exited {
+			return processExit{process: id, status: &status}, true
+		}
+	}
+	p, err := findProcess(id.Pid)
+	if err != nil || !p.Identity().Same(id) {
+		return processExit{process: id}, true
+	}
+	if p.Zombie() {
+		// the process died while stopped: as its tracer we have to reap it,
+		// unless the debugger is waiting for it
+		if d == nil {
+			// reaped by the wrapper
+			return processExit{process: id}, true
+		}
+		if state, err := d.State(); err == nil && !state.Running {
+			if status, ok := reapProcess(id.Pid); ok {
+				return processExit{process: id, status: &status}, true
+			}
+		}
+		return processExit{process: id}, true
+	}
+	return processExit{}, false
+}
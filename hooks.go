@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultHookTimeout is the time a hook may run before it is killed
+const defaultHookTimeout = 10 * time.Second
+
+// hookEnvPrefix starts the names of the environment variables describing the event to the hooks
+const hookEnvPrefix = "DELVEAPPENGINE_"
+
+// Events the hooks are run on
+const (
+	eventAttach = "attach"
+	eventDetach = "detach"
+)
+
+// Reasons of the attach and detach events
+const (
+	reasonProcess  = "process"  // a new module process was found
+	reasonClient   = "client"   // a client connected in lazy mode
+	reasonReattach = "reattach" // reattach asked through the status API
+	reasonPin      = "pin"      // a process was pinned through the status API
+	reasonDetach   = "detach"   // detach asked through the status API
+	reasonExit     = "exit"     // the module process exited
+	reasonIdle     = "idle"     // no client for the idle timeout in lazy mode
+	reasonShutdown = "shutdown" // delveAppengine is stopping
+	reasonWrap     = "wrap"     // the wrapper launched a module process
+)
+
+// hookEvent is an attach or detach of a target, passed to the hook commands
+type hookEvent struct {
+	event   string
+	reason  string
+	process ProcessIdentity
+	exe     string
+}
+
+// hookSettings are the commands run on the attach and detach events
+type hookSettings struct {
+	onAttach string
+	onDetach string
+	timeout  time.Duration
+}
+
+// hooks are the hook commands set with -on-attach and -on-detach
+var hooks = hookSettings{timeout: defaultHookTimeout}
+
+// command returns the command run on the event, empty if none
+func (h hookSettings) command(event string) string {
+	if event == eventAttach {
+		return h.onAttach
+	}
+	return h.onDetach
+}
+
+// runHooks runs the hooks of the events of the target one after the other,
+// in the order of the events, until the channel is closed
+func (t *target) runHooks(events <-chan hookEvent, done chan<- bool) {
+	for e := range events {
+		if command := hooks.command(e.event); len(command) > 0 {
+			t.runHook(command, e)
+		}
+	}
+	close(done)
+}
+
+// fireHook queues the hook of the event, it is dropped if too many hooks are late
+func (t *target) fireHook(e hookEvent) {
+	if len(hooks.command(e.event)) == 0 || t.hooks == nil {
+		return
+	}
+	select {
+	case t.hooks <- e:
+	default:
+		log.Printf("Target %s: too many hooks running late, skipping the %s hook of PID %d\n", t, e.event, e.process.Pid)
+	}
+}
+
+// runHook runs the command with sh, killing it and its children after the
+// hook timeout. Its output is logged line by line.
+func (t *target) runHook(command string, e hookEvent) {
+	prefix := fmt.Sprintf("Target %s: on-%s hook: ", t, e.event)
+	out := &lineLogger{prefix: prefix}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), t.hookEnv(e)...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// in its own process group, to kill the children on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		log.Printf("%scouldn't start: %s\n", prefix, err)
+		return
+	}
+	timedOut := false
+	var mu sync.Mutex
+	timer := time.AfterFunc(hooks.timeout, func() {
+		mu.Lock()
+		timedOut = true
+		mu.Unlock()
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	out.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case timedOut:
+		log.Printf("%skilled after %s\n", prefix, hooks.timeout)
+	case err != nil:
+		log.Printf("%sfailed after %s: %s\n", prefix, time.Since(start), err)
+	}
+}
+
+// hookEnv returns the environment variables describing the event
+func (t *target) hookEnv(e hookEvent) []string {
+	vars := map[string]string{
+		"EVENT":  e.event,
+		"REASON": e.reason,
+		"PID":    strconv.Itoa(e.process.Pid),
+		"EXE":    e.exe,
+		"KEY":    t.key,
+		"MODULE": t.module,
+		"PORT":   strconv.Itoa(t.port),
+		"ADDR":   t.addr(),
+	}
+	if len(t.socket) > 0 {
+		vars["PORT"] = ""
+		vars["ADDR"] = unixPrefix + t.socket
+	}
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, hookEnvPrefix+name+"="+value)
+	}
+	return env
+}
+
+// lineLogger logs the complete lines written to it
+type lineLogger struct {
+	prefix string
+	mu     sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf.Write(p)
+	for {
+		i := bytes.IndexByte(l.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		log.Printf("%s%s\n", l.prefix, l.buf.Next(i + 1)[:i])
+	}
+}
+
+// flush logs the last line, if not terminated
+func (l *lineLogger) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buf.Len() > 0 {
+		log.Printf("%s%s\n", l.prefix, l.buf.String())
+		l.buf.Reset()
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/derekparker/delve/service/api"
+	"github.com/derekparker/delve/service/debugger"
+)
+
+// Load configurations of the "on <bp> args/locals" commands, as in the Delve terminal
+var (
+	longLoadConfig  = api.LoadConfig{FollowPointers: true, MaxVariableRecurse: 1, MaxStringLen: 64, MaxArrayValues: 64, MaxStructFields: -1}
+	shortLoadConfig = api.LoadConfig{FollowPointers: false, MaxVariableRecurse: 0, MaxStringLen: 64, MaxArrayValues: 0, MaxStructFields: 3}
+)
+
+// runInitFile executes a file of Delve terminal commands against the debugger.
+// The supported commands are break, trace, cond and on. A failing line is
+// logged and the rest of the file is still executed.
+func runInitFile(d *debugger.Debugger, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineno++
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		cmd, args := splitCommand(line)
+		if err := runInitCommand(d, cmd, args); err != nil {
+			log.Printf("%s:%d: %s\n", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func runInitCommand(d *debugger.Debugger, cmd string, args string) error {
+	switch cmd {
+	case "break", "b":
+		return setBreakpoint(d, false, args)
+	case "trace", "t":
+		return setBreakpoint(d, true, args)
+	case "condition", "cond":
+		return conditionCommand(d, args)
+	case "on":
+		return onCommand(d, args)
+	}
+	return fmt.Errorf("command %q not supported in an init file", cmd)
+}
+
+// setBreakpoint creates a breakpoint (or tracepoint) on each location of the
+// location spec, the spec can be preceded by the breakpoint name.
+func setBreakpoint(d *debugger.Debugger, tracepoint bool, argstr string) error {
+	if len(argstr) == 0 {
+		return errors.New("address required")
+	}
+
+	requested := &api.Breakpoint{Tracepoint: tracepoint}
+	locspec := argstr
+	if args := strings.SplitN(argstr, " ", 2); len(args) == 2 && api.ValidBreakpointName(args[0]) == nil {
+		requested.Name = args[0]
+		locspec = args[1]
+	}
+
+	scope := api.EvalScope{GoroutineID: -1, Frame: 0}
+	locs, err := d.FindLocation(scope, locspec)
+	if err != nil {
+		if requested.Name == "" {
+			return err
+		}
+		// the first word was not a name after all
+		requested.Name = ""
+		var err2 error
+		if locs, err2 = d.FindLocation(scope, argstr); err2 != nil {
+			return err
+		}
+	}
+
+	for _, loc := range locs {
+		requested.Addr = loc.PC
+		bp, err := d.CreateBreakpoint(requested)
+		if err != nil {
+			return err
+		}
+		log.Printf("Init: %s set at %s\n", describeBreakpoint(bp), formatLocation(loc))
+	}
+	return nil
+}
+
+// conditionCommand handles "cond <breakpoint name or id> <boolean expression>"
+func conditionCommand(d *debugger.Debugger, argstr string) error {
+	args := strings.SplitN(argstr, " ", 2)
+	if len(args) < 2 {
+		return errors.New("not enough arguments")
+	}
+	bp, err := findBreakpoint(d, args[0])
+	if err != nil {
+		return err
+	}
+	bp.Cond = args[1]
+	return d.AmendBreakpoint(bp)
+}
+
+// onCommand handles "on <breakpoint name or id> <command>" where the command
+// is one of print, stack, goroutine, args and locals.
+func onCommand(d *debugger.Debugger, argstr string) error {
+	args := strings.SplitN(argstr, " ", 2)
+	if len(args) < 2 {
+		return errors.New("not enough arguments")
+	}
+	bp, err := findBreakpoint(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	cmd, cmdArgs := splitCommand(args[1])
+	switch cmd {
+	case "print", "p":
+		if len(cmdArgs) == 0 {
+			return errors.New("not enough arguments")
+		}
+		bp.Variables = append(bp.Variables, cmdArgs)
+	case "stack", "bt":
+		depth := 10
+		if len(cmdArgs) > 0 {
+			if depth, err = strconv.Atoi(cmdArgs); err != nil {
+				return errors.New("depth must be a number")
+			}
+		}
+		bp.Stacktrace = depth
+	case "goroutine":
+		if len(cmdArgs) > 0 {
+			return errors.New("too many arguments to goroutine")
+		}
+		bp.Goroutine = true
+	case "args":
+		cfg := loadConfigArg(cmdArgs)
+		bp.LoadArgs = &cfg
+	case "locals":
+		cfg := loadConfigArg(cmdArgs)
+		bp.LoadLocals = &cfg
+	default:
+		return fmt.Errorf("command %q not supported after on", cmd)
+	}
+	return d.AmendBreakpoint(bp)
+}
+
+func findBreakpoint(d *debugger.Debugger, arg string) (*api.Breakpoint, error) {
+	var bp *api.Breakpoint
+	if id, err := strconv.Atoi(arg); err == nil {
+		bp = d.FindBreakpoint(id)
+	} else {
+		bp = d.FindBreakpointByName(arg)
+	}
+	if bp == nil {
+		return nil, fmt.Errorf("no breakpoint %s", arg)
+	}
+	return bp, nil
+}
+
+func loadConfigArg(arg string) api.LoadConfig {
+	if arg == "-v" {
+		return longLoadConfig
+	}
+	return shortLoadConfig
+}
+
+func splitCommand(line string) (string, string) {
+	vals := strings.SplitN(line, " ", 2)
+	if len(vals) == 1 {
+		return vals[0], ""
+	}
+	return vals[0], strings.TrimSpace(vals[1])
+}
+
+func formatLocation(loc api.Location) string {
+	if loc.Function != nil {
+		return fmt.Sprintf("%#x for %s() %s:%d", loc.PC, loc.Function.Name, loc.File, loc.Line)
+	}
+	return fmt.Sprintf("%#x for %s:%d", loc.PC, loc.File, loc.Line)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Instance policies, choosing the instance to debug when a module runs several processes
+const (
+	policyYoungest = "youngest"
+	policyOldest   = "oldest"
+	policyAll      = "all"
+	policyIndex    = "index"
+)
+
+// defaultInstancePolicy is the historical choice of the youngest process
+const defaultInstancePolicy = policyYoungest
+
+// instancePolicy chooses the instance to debug among the processes of a target
+type instancePolicy struct {
+	kind string
+	// index of the instance in start order, for the index policy
+	index int
+}
+
+// parseInstancePolicy parses youngest, oldest, all or index=N
+func parseInstancePolicy(value string) (instancePolicy, error) {
+	switch value {
+	case policyYoungest, policyOldest, policyAll:
+		return instancePolicy{kind: value}, nil
+	}
+	if strings.HasPrefix(value, policyIndex+"=") {
+		index, err := strconv.Atoi(strings.TrimPrefix(value, policyIndex+"="))
+		if err != nil || index < 0 {
+			return instancePolicy{}, fmt.Errorf("invalid instance index in %q", value)
+		}
+		return instancePolicy{kind: policyIndex, index: index}, nil
+	}
+	return instancePolicy{}, fmt.Errorf("unknown instance policy %q, use youngest, oldest, all or index=N", value)
+}
+
+func (p instancePolicy) String() string {
+	if p.kind == policyIndex {
+		return fmt.Sprintf("%s=%d", policyIndex, p.index)
+	}
+	return p.kind
+}
+
+// pick returns the process chosen by the policy. The instances are told apart
+// by their slot, the zombies are ignored. With the all policy, the target
+// itself debugs the first instance.
+func (p instancePolicy) pick(processes []Process, slots instanceSlots) ProcessIdentity {
+	switch p.kind {
+	case policyYoungest:
+		return getRecentProcess(processes)
+	case policyOldest:
+		if live := startOrder(processes); len(live) > 0 {
+			return live[0]
+		}
+		return ProcessIdentity{}
+	}
+	index := p.index
+	if p.kind == policyAll {
+		index = 0
+	}
+	if index >= len(slots) {
+		return ProcessIdentity{}
+	}
+	return slots[index]
+}
+
+// byStart sorts process identities in the order they started, by PID for the same start time
+type byStart []ProcessIdentity
+
+func (s byStart) Len() int      { return len(s) }
+func (s byStart) Swap(a, b int) { s[a], s[b] = s[b], s[a] }
+func (s byStart) Less(a, b int) bool {
+	if s[a].StartTime != s[b].StartTime {
+		return s[a].StartTime < s[b].StartTime
+	}
+	return s[a].Pid < s[b].Pid
+}
+
+// startOrder returns the processes that are not zombies, the oldest first
+func startOrder(processes []Process) []ProcessIdentity {
+	live := []ProcessIdentity{}
+	for _, p := range processes {
+		if !p.Zombie() {
+			live = append(live, p.Identity())
+		}
+	}
+	sort.Sort(byStart(live))
+	return live
+}
+
+// instanceSlots are the processes of the instances by index, a zero identity
+// for the instance whose process exited. The first processes are numbered in
+// start order, then each process keeps its slot while it runs: the process of
+// a restarted instance takes the free slot, the other instances keep theirs.
+type instanceSlots []ProcessIdentity
+
+// assign returns the slots of the live processes, given the oldest first
+func (s instanceSlots) assign(live []ProcessIdentity) instanceSlots {
+	slots := make(instanceSlots, len(s))
+	kept := map[int]bool{}
+	for index, id := range s {
+		for i, p := range live {
+			if !kept[i] && !id.IsZero() && p.Same(id) {
+				slots[index] = p
+				kept[i] = true
+				break
+			}
+		}
+	}
+	free := 0
+	for i, p := range live {
+		if kept[i] {
+			continue
+		}
+		for free < len(slots) && !slots[free].IsZero() {
+			free++
+		}
+		if free < len(slots) {
+			slots[free] = p
+		} else {
+			slots = append(slots, p)
+		}
+	}
+	return slots
+}
+
+// index returns the slot of the process, -1 if it has none
+func (s instanceSlots) index(id ProcessIdentity) int {
+	for index, slot := range s {
+		if !slot.IsZero() && slot.Same(id) {
+			return index
+		}
+	}
+	return -1
+}
+
+// updateSlots assigns the candidates to the slots of the instances
+func (t *target) updateSlots(candidates []Process) {
+	live := startOrder(candidates)
+	t.mu.Lock()
+	t.slots = t.slots.assign(live)
+	t.mu.Unlock()
+}
+
+// instanceSlots returns the slots of the instances, kept by the target of the
+// first instance
+func (t *target) instanceSlots() instanceSlots {
+	owner := t
+	if t.parent != nil {
+		owner = t.parent
+	}
+	owner.mu.Lock()
+	defer owner.mu.Unlock()
+	return owner.slots
+}
+
+// discover numbers the instances of the target among the processes found by
+// a scan. The slots are the only numbering: the instance index shown in the
+// status and the logs is the one the index and all policies debug. It returns
+// the candidates of the target and the status of the processes.
+func (t *target) discover(found []*scannedProcess) ([]Process, []processStatus) {
+	candidates := []Process{}
+	for _, m := range found {
+		if m.matches[t] {
+			candidates = append(candidates, m.p)
+		}
+	}
+	t.updateSlots(candidates)
+	slots := t.instanceSlots()
+
+	discovered := []processStatus{}
+	for _, m := range found {
+		info := m.info
+		info.Instance = -1
+		if m.matches[t] {
+			info.Instance = slots.index(m.p.Identity())
+		}
+		discovered = append(discovered, newProcessStatus(m.p, info, m.matches[t]))
+	}
+	return candidates, discovered
+}
+
+// reservedPorts are the ports of the configured targets, not given to the instances of the all policy
+var reservedPorts = map[int]bool{}
+
+// dispatch pushes the process chosen among the candidates to the target and,
+// with the all policy, each other instance to its own target
+func (t *target) dispatch(candidates []Process, discovered []processStatus) {
+	if id := t.choose(candidates); !id.IsZero() && !id.Same(t.debuggedProcess()) {
+		t.pidChan <- id
+	}
+	if t.policy.kind != policyAll {
+		return
+	}
+	for _, instance := range t.spawnInstances(len(t.instanceSlots())) {
+		instance.setDiscovered(discovered)
+		instance.dispatch(candidates, discovered)
+	}
+}
+
+// spawnInstances returns the targets of the instances after the first one,
+// starting the missing ones. They are kept when the instances exit, so that
+// each one keeps its port across restarts.
+func (t *target) spawnInstances(count int) []*target {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for index := len(t.instances) + 1; index < count; index++ {
+		instance := t.newInstance(index)
+		t.instances = append(t.instances, instance)
+		log.Printf("Target %s: debugging instance %d on %s\n", t, index, instance)
+		go instance.run()
+	}
+	return append([]*target{}, t.instances...)
+}
+
+// newInstance builds the target of an instance of the all policy: on the
+// port after the previous instance, or on an auto-selected port
+func (t *target) newInstance(index int) *target {
+	port := 0
+	if !t.autoPort && len(t.socket) == 0 {
+		port = t.port + index
+		if reservedPorts[port] {
+			log.Printf("Target %s: port %d is used by another target, auto-selecting the port of instance %d\n", t, port, index)
+			port = 0
+		}
+	}
+	instance := newTarget(t.key, t.module, port)
+	instance.parent = t
+	instance.policy = instancePolicy{kind: policyIndex, index: index}
+	instance.status.Key = fmt.Sprintf("%s#%d", t.key, index)
+	instance.matcher = t.matcher
+	instance.host = t.host
+	if len(t.socket) > 0 {
+		instance.socket = fmt.Sprintf("%s.%d", t.socket, index)
+	}
+	instance.apiVersion = t.apiVersion
+	instance.autoContinue = t.autoContinue
+	instance.initFile = t.initFile
+	instance.traceFilter = t.traceFilter
+	instance.traceDepth = t.traceDepth
+	instance.lazy = t.lazy
+	instance.idleTimeout = t.idleTimeout
+	instance.early = t.early
+	return instance
+}
+
+// instanceTargets returns the targets of the instances after the first one, with the all policy
+func (t *target) instanceTargets() []*target {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*target{}, t.instances...)
+}
+
+// withInstances returns the targets followed by the targets of their instances
+func withInstances(targets []*target) []*target {
+	all := []*target{}
+	for _, t := range targets {
+		all = append(all, t)
+		all = append(all, t.instanceTargets()...)
+	}
+	return all
+}
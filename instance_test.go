@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInstancePolicy(t *testing.T) {
+	tests := []struct {
+		value  string
+		policy instancePolicy
+	}{
+		{"youngest", instancePolicy{kind: policyYoungest}},
+		{"oldest", instancePolicy{kind: policyOldest}},
+		{"all", instancePolicy{kind: policyAll}},
+		{"index=2", instancePolicy{kind: policyIndex, index: 2}},
+	}
+	for _, test := range tests {
+		policy, err := parseInstancePolicy(test.value)
+		if err != nil {
+			t.Errorf("parseInstancePolicy(%q): %s", test.value, err)
+			continue
+		}
+		if policy != test.policy || policy.String() != test.value {
+			t.Errorf("parseInstancePolicy(%q) = %+v", test.value, policy)
+		}
+	}
+	for _, value := range []string{"", "newest", "index=", "index=-1", "index=x"} {
+		if _, err := parseInstancePolicy(value); err == nil {
+			t.Errorf("parseInstancePolicy(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func identities(processes ...*fakeProcess) []ProcessIdentity {
+	ids := []ProcessIdentity{}
+	for _, p := range processes {
+		if p == nil {
+			ids = append(ids, ProcessIdentity{})
+			continue
+		}
+		ids = append(ids, p.Identity())
+	}
+	return ids
+}
+
+func TestInstanceSlots(t *testing.T) {
+	a := &fakeProcess{pid: 10, start: 1}
+	b := &fakeProcess{pid: 11, start: 2}
+	c := &fakeProcess{pid: 12, start: 3}
+	d := &fakeProcess{pid: 13, start: 4}
+	e := &fakeProcess{pid: 14, start: 5}
+	f := &fakeProcess{pid: 15, start: 6}
+	// a new process that got the PID of b
+	b2 := &fakeProcess{pid: 11, start: 7}
+
+	steps := []struct {
+		live  []*fakeProcess
+		slots []*fakeProcess
+	}{
+		// numbered in start order
+		{[]*fakeProcess{a, b, c}, []*fakeProcess{a, b, c}},
+		// instance 1 restarts: the others keep their index
+		{[]*fakeProcess{a, c}, []*fakeProcess{a, nil, c}},
+		{[]*fakeProcess{a, c, d}, []*fakeProcess{a, d, c}},
+		// the free slots are filled in order, then new ones are added
+		{[]*fakeProcess{d}, []*fakeProcess{nil, d, nil}},
+		{[]*fakeProcess{d, e, b2, f}, []*fakeProcess{e, d, b2, f}},
+	}
+	var slots instanceSlots
+	for i, step := range steps {
+		slots = slots.assign(identities(step.live...))
+		if want := instanceSlots(identities(step.slots...)); !reflect.DeepEqual(slots, want) {
+			t.Fatalf("step %d: slots %v, want %v", i, slots, want)
+		}
+	}
+}
+
+func TestInstancePolicyPick(t *testing.T) {
+	a := &fakeProcess{pid: 10, start: 1}
+	b := &fakeProcess{pid: 11, start: 2}
+	c := &fakeProcess{pid: 12, start: 3}
+	zombie := &fakeProcess{pid: 9, start: 0, zombie: true}
+	processes := []Process{c, zombie, a, b}
+	slots := instanceSlots(identities(c, nil, b))
+
+	tests := []struct {
+		policy instancePolicy
+		want   *fakeProcess
+	}{
+		{instancePolicy{kind: policyYoungest}, c},
+		{instancePolicy{kind: policyOldest}, a},
+		{instancePolicy{kind: policyAll}, c},
+		{instancePolicy{kind: policyIndex, index: 0}, c},
+		// the process of instance 1 exited
+		{instancePolicy{kind: policyIndex, index: 1}, nil},
+		{instancePolicy{kind: policyIndex, index: 2}, b},
+		{instancePolicy{kind: policyIndex, index: 3}, nil},
+	}
+	for _, test := range tests {
+		want := ProcessIdentity{}
+		if test.want != nil {
+			want = test.want.Identity()
+		}
+		if id := test.policy.pick(processes, slots); id != want {
+			t.Errorf("%s: picked %s, want %s", test.policy, id, want)
+		}
+	}
+}
+
+func TestInstanceNumberingAcrossRestart(t *testing.T) {
+	frontend := newTarget("frontend", "", 2345)
+	frontend.policy = instancePolicy{kind: policyIndex, index: 1}
+	other := newTarget("worker", "", 2346)
+	scan := func(processes ...*fakeProcess) []Process {
+		found := []*scannedProcess{}
+		for _, p := range processes {
+			found = append(found, &scannedProcess{
+				p:       p,
+				info:    ModuleInfo{Name: "frontend", Instance: -1},
+				matches: map[*target]bool{frontend: true, other: false},
+			})
+		}
+		candidates, discovered := frontend.discover(found)
+		frontend.setDiscovered(discovered)
+		return candidates
+	}
+	// checkInstance checks that the instance 1 of the status and the logs is
+	// the process the policy debugs
+	checkInstance := func(step string, candidates []Process, want *fakeProcess) {
+		debugged := frontend.choose(candidates)
+		if debugged != want.Identity() {
+			t.Errorf("%s: index=1 debugs %s, want %s", step, debugged, want.Identity())
+		}
+		for _, p := range frontend.Status().Processes {
+			if (p.Instance != nil && *p.Instance == 1) != (p.PID == want.pid) {
+				t.Errorf("%s: PID %d has instance %v in the status", step, p.PID, p.Instance)
+			}
+		}
+		if label := frontend.describe(debugged); label != debugged.String()+", module frontend instance 1" {
+			t.Errorf("%s: debugged process labeled %q", step, label)
+		}
+	}
+
+	a := &fakeProcess{pid: 10, start: 1}
+	b := &fakeProcess{pid: 11, start: 2}
+	c := &fakeProcess{pid: 12, start: 3}
+	d := &fakeProcess{pid: 13, start: 4}
+	checkInstance("start", scan(c, a, b), b)
+	// instance 1 restarts as d, which is younger than c
+	checkInstance("restart", scan(a, c, d), d)
+	for _, p := range frontend.Status().Processes {
+		if p.PID == c.pid && (p.Instance == nil || *p.Instance != 2) {
+			t.Errorf("restart: the instance of PID %d changed to %v, want 2", p.PID, p.Instance)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// errListenerClosed is returned by Accept once the connListener is closed
+var errListenerClosed = errors.New("listener closed")
+
+// connListener is the listener of a Delve server in lazy mode: the target owns
+// the port and hands the accepted connections to the server.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan bool
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan bool)}
+}
+
+// push hands a connection to the server, it fails if the server is stopped
+func (l *connListener) push(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.done:
+		return errListenerClosed
+	}
+}
+
+// Accept implements net.Listener
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+// Close implements net.Listener
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr implements net.Listener
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// trackedConn reports when the client is gone, on close or on the first read error
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	gone func()
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.once.Do(c.gone)
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.gone)
+	return c.Conn.Close()
+}
+
+// acceptClients accepts the client connections on the port of the target, in
+// lazy mode without proxy
+func (t *target) acceptClients(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Target %s stopped accepting connections: %s\n", t, err)
+			return
+		}
+		t.clientConns <- &trackedConn{Conn: conn, gone: t.clientGone}
+	}
+}
+
+// clientEvent reports a connection (1) or a disconnection (-1) of a client of
+// the proxy to the run loop. The send is synchronous: the disconnection of a
+// client can't reach the run loop before its connection.
+func (t *target) clientEvent(delta int) {
+	t.clients <- delta
+}
+
+// clientGone reports the disconnection of a client to the run loop
+func (t *target) clientGone() {
+	go func() { t.clients <- -1 }()
+}
+
+// clientConnected counts a new client and attaches the pending process to
+// serve it, if not attached yet
+func (t *target) clientConnected() {
+	t.mu.Lock()
+	t.status.Clients++
+	pending := t.pending
+	t.mu.Unlock()
+	t.idle = nil
+
+	if t.stopChan == nil && !pending.IsZero() {
+		log.Printf("Target %s: client connected\n", t)
+		if err := t.attach(pending, reasonClient); err != nil {
+			log.Printf("Target %s: %s\n", t, err)
+		}
+	}
+}
+
+// clientDisconnected counts a client gone and starts the idle timeout after the last one
+func (t *target) clientDisconnected() {
+	t.mu.Lock()
+	t.status.Clients--
+	clients := t.status.Clients
+	t.mu.Unlock()
+
+	if clients == 0 && t.idleTimeout > 0 && t.stopChan != nil {
+		t.idle = time.After(t.idleTimeout)
+	}
+}
+
+// idleDetach detaches from the process when no client used it for the idle
+// timeout, it is attached again when the next client connects
+func (t *target) idleDetach() {
+	t.idle = nil
+	id := t.attachedProcess()
+	if id.IsZero() {
+		return
+	}
+	log.Printf("Target %s: no client for %s, detaching from PID %d\n", t, t.idleTimeout, id.Pid)
+	t.detach(reasonIdle)
+	t.mu.Lock()
+	t.pending = id
+	t.mu.Unlock()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultHost is the host the Delve servers listen on when none is given:
+// a debugger can write the memory of the module and kill it, it must not be
+// reachable from the network by default
+const defaultHost = "127.0.0.1"
+
+// unixPrefix starts the listen addresses of Unix sockets
+const unixPrefix = "unix:"
+
+// listenAddr is a parsed listen address: a TCP host with an optional port, or a Unix socket
+type listenAddr struct {
+	host   string
+	port   int // 0 when not given
+	socket string
+}
+
+// parseListen parses a listen address: host, host:port, [ipv6]:port or unix:/path/to/socket
+func parseListen(value string) (listenAddr, error) {
+	if strings.HasPrefix(value, unixPrefix) {
+		socket := strings.TrimPrefix(value, unixPrefix)
+		if len(socket) == 0 {
+			return listenAddr{}, errors.New("the path of the Unix socket is missing")
+		}
+		return listenAddr{socket: socket}, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(value)
+	if err != nil {
+		// no port
+		host = value
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		if strings.ContainsAny(host, "[]") {
+			return listenAddr{}, fmt.Errorf("invalid listen address %q", value)
+		}
+		return listenAddr{host: host}, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return listenAddr{}, fmt.Errorf("invalid port in listen address %q", value)
+	}
+	return listenAddr{host: host, port: port}, nil
+}
+
+// network returns the network of the Delve server of the target
+func (t *target) network() string {
+	if len(t.socket) > 0 {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// setListen applies a listen address to the target
+func (t *target) setListen(addr listenAddr) {
+	if len(addr.socket) > 0 {
+		t.socket = addr.socket
+		t.port = 0
+		return
+	}
+	t.socket = ""
+	t.host = addr.host
+	if addr.port > 0 {
+		t.port = addr.port
+	}
+}
+
+// listen makes a listener, waiting for the address to be available: only an
+// address in use is retried, the other errors are returned. Unix sockets are
+// only accessible to the user and a stale socket file is removed.
+func listen(network string, addr string) (net.Listener, error) {
+	for {
+		var listener net.Listener
+		var err error
+		if network == "unix" {
+			removeStaleSocket(addr)
+			listener, err = listenPrivateUnix(addr)
+		} else {
+			listener, err = net.Listen(network, addr)
+		}
+		if err == nil || !addrInUse(err) {
+			return listener, err
+		}
+		log.Printf("Couldn't start listener: %s\n", err)
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// addrInUse tells if a listen error is caused by another listener on the
+// address, or by an existing file at the path of a Unix socket
+func addrInUse(err error) bool {
+	switch err := err.(type) {
+	case *net.OpError:
+		if sysErr, ok := err.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.EADDRINUSE
+		}
+	case *os.LinkError:
+		return os.IsExist(err)
+	}
+	return false
+}
+
+// privateUnixListener is a Unix socket linked at its path by listenPrivateUnix
+type privateUnixListener struct {
+	net.Listener
+	path string
+}
+
+// Addr returns the path the socket is linked at
+func (l *privateUnixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close closes the listener and removes its socket file
+func (l *privateUnixListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// listenPrivateUnix listens on a Unix socket only accessible to the user: the
+// socket is created in a private directory next to the path and given the
+// 0600 mode before being linked at the path, there is no window in which
+// other users may connect. An existing file at the path is not replaced.
+func listenPrivateUnix(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".dae")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(tmp, 0600); err == nil {
+		err = os.Link(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &privateUnixListener{Listener: listener, path: path}, nil
+}
+
+// backends is the private directory of the Unix sockets of the Delve servers
+// behind the proxies, created on first use
+var backends struct {
+	sync.Mutex
+	dir   string
+	count int
+}
+
+// listenBackend makes the listener of a Delve server behind a proxy: a Unix
+// socket in a directory only accessible to the user, the server is not
+// reachable by the other users of the host, even without token. The mode of
+// the directory is enough, the socket itself keeps the default one.
+func listenBackend() (net.Listener, error) {
+	backends.Lock()
+	defer backends.Unlock()
+	if len(backends.dir) == 0 {
+		dir, err := ioutil.TempDir("", "delveAppengine")
+		if err != nil {
+			return nil, err
+		}
+		backends.dir = dir
+	}
+	backends.count++
+	return net.Listen("unix", filepath.Join(backends.dir, fmt.Sprintf("delve-%d.sock", backends.count)))
+}
+
+// removeBackends removes the directory of the Unix sockets of the Delve servers
+func removeBackends() {
+	backends.Lock()
+	defer backends.Unlock()
+	if len(backends.dir) > 0 {
+		os.RemoveAll(backends.dir)
+		backends.dir = ""
+	}
+}
+
+// backendAddr returns the address of a Delve server for the proxy, Unix
+// sockets are prefixed with unix:
+func backendAddr(listener net.Listener) string {
+	if addr, ok := listener.Addr().(*net.UnixAddr); ok {
+		return unixPrefix + addr.Name
+	}
+	return listener.Addr().String()
+}
+
+// dialBackend connects to a Delve server given by backendAddr
+func dialBackend(addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return net.Dial("unix", strings.TrimPrefix(addr, unixPrefix))
+	}
+	return net.Dial("tcp", addr)
+}
+
+// removeStaleSocket removes the socket file if no server is listening on it anymore
+func removeStaleSocket(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		// still in use
+		conn.Close()
+		return
+	}
+	if err := os.Remove(path); err == nil {
+		log.Printf("Removed stale socket %s\n", path)
+	}
+}
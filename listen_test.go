@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		value string
+		addr  listenAddr
+	}{
+		{"127.0.0.1", listenAddr{host: "127.0.0.1"}},
+		{"0.0.0.0:3000", listenAddr{host: "0.0.0.0", port: 3000}},
+		{"localhost:2345", listenAddr{host: "localhost", port: 2345}},
+		{"::1", listenAddr{host: "::1"}},
+		{"[::1]", listenAddr{host: "::1"}},
+		{"[::1]:2345", listenAddr{host: "::1", port: 2345}},
+		{"unix:/tmp/delve.sock", listenAddr{socket: "/tmp/delve.sock"}},
+	}
+	for _, test := range tests {
+		addr, err := parseListen(test.value)
+		if err != nil {
+			t.Errorf("parseListen(%q): %s", test.value, err)
+			continue
+		}
+		if addr != test.addr {
+			t.Errorf("parseListen(%q) = %+v, want %+v", test.value, addr, test.addr)
+		}
+	}
+
+	for _, value := range []string{"unix:", "127.0.0.1:0", "127.0.0.1:65536", "127.0.0.1:x", "[::1"} {
+		if addr, err := parseListen(value); err == nil {
+			t.Errorf("parseListen(%q) = %+v, want an error", value, addr)
+		}
+	}
+}
+
+func TestListenUnixPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delveappengine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "delve.sock")
+	listener, err := listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		t.Errorf("socket mode %o, want no access for the others", mode)
+	}
+	if addr := listener.Addr().String(); addr != path {
+		t.Errorf("listener address %q, want %q", addr, path)
+	}
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial %s: %s", path, err)
+	}
+	conn.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the directory of the socket, want only the socket", len(files))
+	}
+
+	listener.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after Close: %v", err)
+	}
+}
+
+func TestListenErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delveappengine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// not retried
+	if _, err := listen("unix", filepath.Join(dir, "missing", "delve.sock")); err == nil {
+		t.Error("listen in a missing directory succeeded")
+	}
+	if _, err := listen("tcp", "256.0.0.1:0"); err == nil {
+		t.Error("listen on an invalid address succeeded")
+	}
+
+	// an existing file is not replaced, and is reported as an address in use
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = listenPrivateUnix(path)
+	if err == nil || !addrInUse(err) {
+		t.Errorf("listenPrivateUnix on an existing file: %v, want an address in use", err)
+	}
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("existing file replaced: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := net.Listen("tcp", listener.Addr().String()); err == nil || !addrInUse(err) {
+		t.Errorf("second listener on %s: %v, want an address in use", listener.Addr(), err)
+	}
+}
+
+func TestListenBackend(t *testing.T) {
+	defer removeBackends()
+	listener, err := listenBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	addr := backendAddr(listener)
+	if !strings.HasPrefix(addr, unixPrefix) {
+		t.Fatalf("backend address %q, want a Unix socket", addr)
+	}
+	info, err := os.Stat(filepath.Dir(strings.TrimPrefix(addr, unixPrefix)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0700 {
+		t.Errorf("directory of the backend sockets has mode %o, want 700", mode)
+	}
+	conn, err := dialBackend(addr)
+	if err != nil {
+		t.Fatalf("dialBackend(%q): %s", addr, err)
+	}
+	conn.Close()
+}
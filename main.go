@@ -1,164 +1,410 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net"
-	"sort"
+	"os"
+	"regexp"
 	"sync"
 	"time"
-
-	"github.com/derekparker/delve/service"
-	"github.com/derekparker/delve/service/rpccommon"
 )
 
-//DebuggedPID PID of process currently attached tot he debugger
-var DebuggedPID = 0
-
-//PidChan Used to PID the PID to whcih we need to attach the debugger
-var PidChan = make(chan int)
+// eventsSafetyPoll is the delay between two scans when the process events are
+// used, so that a missed event is noticed anyway
+const eventsSafetyPoll = 30 * time.Second
 
 var port int
 var delaySeconds int
 var magicKey string
+var moduleSelector string
+var targetsFlag string
+var useProcessEvents bool
+var useProxy bool
+var statusAddr string
+var configPath string
+var autoContinue bool
+var initFile string
+var traceFilter string
+var traceDepth int
+var matchExpr string
+var lazyAttach bool
+var idleDetach time.Duration
+var earlyAttach bool
+var listenFlag string
+var tokenFlag string
+var tokenFile string
+var authToken string
+var instancesFlag string
+var useTLS bool
+var tlsSettings TLSConfig
+var tlsConfig *tls.Config
 
 func main() {
-	flag.IntVar(&port, "port", 2345, "Port used by the Delve server")
+	if len(os.Args) > 1 && os.Args[1] == "wrap" {
+		os.Exit(runWrap(os.Args[2:]))
+	}
+
+	flag.IntVar(&port, "port", 2345, "Port used by the Delve server, 0 to select a free port for each target")
 	flag.IntVar(&delaySeconds, "delay", 3, "Time delay in seconds between each appengine process scan")
 	flag.StringVar(&magicKey, "key", "", "Magic key to identify a specific module bianry (default is empty string)")
+	flag.StringVar(&moduleSelector, "module", "", "Module to debug, as name or name:version, identified from the module process environment or the dev_appserver arguments")
+	flag.StringVar(&targetsFlag, "targets", "", "Multi-target mode: comma separated list of module keys, each one debugged on its own port. Use key=port to choose the port, otherwise ports are assigned from -port upward (example: frontend=2345,worker=2346)")
+	flag.BoolVar(&useProcessEvents, "events", false, "Linux only: react to the module processes exec and exit events of the kernel proc connector instead of polling (needs CAP_NET_ADMIN, falls back to polling), with a scan every 30s in case events are lost")
+	flag.BoolVar(&useProxy, "proxy", true, "Keep the port open across module restarts and proxy the JSON-RPC connections to the Delve server of the current module process")
+	flag.StringVar(&listenFlag, "listen", "", "Address of the Delve server: host, host:port, [::1]:port or unix:/path/to/socket (default 127.0.0.1 on -port)")
+	flag.StringVar(&tokenFlag, "token", "", "Token the debugger clients must send with RPCServer.Authenticate before any other call (default $"+tokenEnv+", authentication disabled if none)")
+	flag.StringVar(&tokenFile, "token-file", "", "File of the authentication token, generated with a random token if it doesn't exist")
+	flag.BoolVar(&useTLS, "tls", false, "Serve the Delve servers over TLS, with a self-signed certificate unless -tls-cert and -tls-key are given")
+	flag.StringVar(&tlsSettings.Cert, "tls-cert", "", "PEM file of the TLS certificate of the Delve servers (implies -tls)")
+	flag.StringVar(&tlsSettings.Key, "tls-key", "", "PEM file of the private key of -tls-cert")
+	flag.StringVar(&tlsSettings.ClientCA, "tls-client-ca", "", "PEM file of CAs: the debugger clients must present a certificate signed by one of them (implies -tls)")
+	flag.StringVar(&hooks.onAttach, "on-attach", "", "Shell command run after each attach, with the event in the DELVEAPPENGINE_EVENT, _REASON, _PID, _EXE, _KEY, _MODULE, _PORT and _ADDR environment variables")
+	flag.StringVar(&hooks.onDetach, "on-detach", "", "Shell command run after each detach, with the same environment variables as -on-attach")
+	flag.DurationVar(&hooks.timeout, "hook-timeout", defaultHookTimeout, "Time the -on-attach and -on-detach commands may run before they are killed")
+	flag.StringVar(&discoveryPath, "discovery", "", "JSON file listing the address, module process and API version of each target (default "+defaultDiscoveryPath+" when a port is auto-selected)")
+	flag.BoolVar(&updateVSCode, "vscode", false, "Add or update a remote attach configuration for each target in "+launchPath)
+	flag.StringVar(&statusAddr, "status-addr", "", "Address of the status and control HTTP API, for example 127.0.0.1:2300 (disabled by default)")
+	flag.BoolVar(&autoContinue, "continue", false, "Continue the module process right after attach so that it keeps serving requests until a breakpoint is hit (default true with a configuration file)")
+	flag.StringVar(&initFile, "init", "", "File of Delve commands (break, trace, cond, on) run against each newly attached module process")
+	flag.StringVar(&traceFilter, "trace", "", "Headless trace mode: set a tracepoint on every function matching the regexp on each attached module process and continue it, printing each hit")
+	flag.IntVar(&traceDepth, "stack", 0, "Depth of the stack printed on each tracepoint hit of the trace mode")
+	flag.StringVar(&matchExpr, "match", defaultMatcher, "Expression selecting the module processes: name:<name>, name-re:<regexp>, exe-re:<regexp on the path>, parent:<program of a parent process>, cmdline:<substring>, combined with && and ||")
+	flag.StringVar(&instancesFlag, "instances", defaultInstancePolicy, "Instance to debug when a module runs several processes: youngest, oldest, all (one Delve server per instance on consecutive ports) or index=N (by start order, from 0)")
+	flag.BoolVar(&lazyAttach, "lazy", false, "Attach the module process only when a debugger client connects, so that the module runs at full speed while nobody is debugging")
+	flag.DurationVar(&idleDetach, "idle-detach", 0, "With -lazy, detach from the module process when no client is connected for that long, for example 5m (disabled by default)")
+	flag.BoolVar(&earlyAttach, "early", false, "Linux only: stop the module processes at exec and attach them before their initialization, they then wait for a client in main.init unless -init sets breakpoints")
+	flag.StringVar(&configPath, "config", "", "Configuration file (default is "+configFileName+" in the working directory, if present)")
 	flag.Parse()
 
+	targets, err := configure()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if len(statusAddr) > 0 {
+		if err := serveStatus(statusAddr, targets); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
+
+	// the ports of the targets are not given to the instances by the scanner
+	for _, t := range targets {
+		if t.port > 0 {
+			reservedPorts[t.port] = true
+		}
+	}
+
 	// Monitor the appengine modules processes
-	go func() {
-		checkAppengineModuleProcess()
-		for range time.Tick(time.Duration(delaySeconds) * time.Second) {
-			checkAppengineModuleProcess()
+	stopWatching := make(chan bool)
+	var scan chan bool
+	for _, t := range targets {
+		if t.early && scan == nil {
+			scan = make(chan bool, 1)
+			go watchExecs(targets, scan, stopWatching)
 		}
-	}()
+	}
+	go watchAppengineModuleProcess(targets, scan, stopWatching)
+	go handleSignals(targets, stopWatching)
+
+	startDiscovery(targets)
+
+	// Wait for a PID and attach a new debugger to it, each target on its own
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			t.run()
+		}(t)
+	}
+	wg.Wait()
+	stopDiscovery()
+	removeBackends()
+	log.Println("delveAppengine stopped")
+}
+
+//configure loads the configuration file, if any, and builds the targets. The flags set on the command line override the file values.
+func configure() ([]*target, error) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	if len(initFile) > 0 {
+		if _, err := os.Stat(initFile); err != nil {
+			return nil, err
+		}
+	}
+	matcher, err := ParseMatcher(matchExpr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -match: %s", err)
+	}
+	if len(traceFilter) > 0 {
+		if _, err := regexp.Compile(traceFilter); err != nil {
+			return nil, fmt.Errorf("invalid -trace regexp: %s", err)
+		}
+	}
+	policy, err := parseInstancePolicy(instancesFlag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -instances: %s", err)
+	}
+	var listenAt listenAddr
+	if len(listenFlag) > 0 {
+		if listenAt, err = parseListen(listenFlag); err != nil {
+			return nil, fmt.Errorf("invalid -listen: %s", err)
+		}
+	}
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid -port %d", port)
+	}
+	if idleDetach < 0 {
+		return nil, fmt.Errorf("invalid -idle-detach %s", idleDetach)
+	}
+	if cfg != nil {
+		log.Printf("Using configuration file %s\n", cfg.path)
+		cfg.applySettings(setFlags)
+	}
+	if hooks.timeout <= 0 {
+		return nil, fmt.Errorf("invalid hook timeout %s", hooks.timeout)
+	}
+	if authToken, err = loadToken(tokenFlag, tokenFile); err != nil {
+		return nil, fmt.Errorf("couldn't load the authentication token: %s", err)
+	}
+	if len(authToken) > 0 {
+		log.Println("Debugger clients must authenticate with the token")
+	}
 
-	// Wait for a PID and attach a new debugger to it
-	var stopChan chan bool
-	for pid := range PidChan {
-		if pid != DebuggedPID && pid != 0 {
-			if stopChan != nil {
-				stopChan <- true
-				waitForFreePort()
+	var targets []*target
+	fromFlags := cfg == nil || setFlags["targets"]
+	if fromFlags {
+		targets, err = parseTargets(targetsFlag, magicKey, moduleSelector, port)
+	} else {
+		targets, err = cfg.buildTargets(setFlags, magicKey, moduleSelector, port)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(targets) > 1 && (listenAt.port > 0 || len(listenAt.socket) > 0) {
+		return nil, errors.New("-listen can only give a host to several targets, each one has its own port")
+	}
+	for _, t := range targets {
+		if len(listenFlag) > 0 {
+			t.setListen(listenAt)
+		}
+		if fromFlags || setFlags["match"] {
+			t.matcher = matcher
+		}
+		if fromFlags || setFlags["continue"] {
+			t.autoContinue = autoContinue
+		}
+		if fromFlags {
+			t.initFile = initFile
+		}
+		if fromFlags || setFlags["instances"] {
+			t.policy = policy
+		}
+		if fromFlags || setFlags["lazy"] {
+			t.lazy = lazyAttach
+		}
+		if fromFlags || setFlags["idle-detach"] {
+			t.idleTimeout = idleDetach
+		}
+		if fromFlags || setFlags["early"] {
+			t.early = earlyAttach
+		}
+		if len(traceFilter) > 0 {
+			// nobody is there to continue the process after a hit, nor to connect
+			t.traceFilter = traceFilter
+			t.traceDepth = traceDepth
+			t.autoContinue = true
+			t.lazy = false
+		}
+		if t.idleTimeout > 0 && !t.lazy {
+			return nil, fmt.Errorf("target %s: the idle detach needs the lazy mode", t)
+		}
+		if t.early && !earlyAttachSupported {
+			return nil, fmt.Errorf("target %s: the early attach is not supported on this system", t)
+		}
+		if t.early && t.lazy {
+			return nil, fmt.Errorf("target %s: the early attach can't wait for a client to attach, it conflicts with the lazy mode", t)
+		}
+	}
+
+	if useTLS || len(tlsSettings.Cert) > 0 || len(tlsSettings.ClientCA) > 0 {
+		var hosts []string
+		for _, t := range targets {
+			if len(t.socket) == 0 {
+				hosts = append(hosts, t.host)
 			}
-			DebuggedPID = pid
-			stopChan = attachDelveServer(DebuggedPID)
+		}
+		if tlsConfig, err = serverTLSConfig(tlsSettings, hosts); err != nil {
+			return nil, fmt.Errorf("couldn't set up TLS: %s", err)
+		}
+		if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+			log.Println("Debugger clients must present a TLS certificate signed by the client CA")
 		}
 	}
+	return targets, nil
 }
 
-//checkAppengineModuleProcess llok after the Appengine module process and push the latest new PID into channel
-func checkAppengineModuleProcess() {
+//watchAppengineModuleProcess scans the processes each time a module process starts or exits when
+//the process events are available, every delaySeconds otherwise, until stop is closed. A scan is also
+//run on each request of the scan channel.
+func watchAppengineModuleProcess(targets []*target, scan <-chan bool, stop <-chan bool) {
+	var events <-chan processEvent
+	if useProcessEvents {
+		var err error
+		if events, err = watchProcessEvents(); err != nil {
+			log.Printf("Process events unavailable, polling every %ds: %s\n", delaySeconds, err)
+		}
+	}
+
+	modulePids, err := checkAppengineModuleProcess(targets)
+	if err != nil {
+		scanFailed(err)
+	} else {
+		scanSucceeded()
+	}
+	tick := time.Tick(time.Duration(delaySeconds) * time.Second)
+	safety := time.Tick(eventsSafetyPoll)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-scan:
+		case <-tick:
+			if events != nil {
+				continue
+			}
+		case <-safety:
+			if events == nil {
+				// already polling
+				continue
+			}
+		case e, ok := <-events:
+			if !ok {
+				log.Printf("Process events lost, polling every %ds\n", delaySeconds)
+				events = nil
+				continue
+			}
+			if !isModuleProcessEvent(targets, e, modulePids) {
+				continue
+			}
+		}
+		if !scanReady() {
+			continue
+		}
+		pids, err := checkAppengineModuleProcess(targets)
+		if err != nil {
+			scanFailed(err)
+			continue
+		}
+		scanSucceeded()
+		modulePids = pids
+	}
+}
+
+//isModuleProcessEvent returns true if the event concerns a module process: the exec of a new one or the exit of a known one.
+//Lost events may have been about a module process.
+func isModuleProcessEvent(targets []*target, e processEvent, modulePids map[int]bool) bool {
+	if e.Lost {
+		log.Println("Process events were lost, scanning the processes")
+		return true
+	}
+	if !e.Exec {
+		return modulePids[e.Pid]
+	}
+	p, err := findProcess(e.Pid)
+	if err != nil {
+		return false
+	}
+	return isModuleProcess(targets, p)
+}
+
+//isModuleProcess returns true if the process runs the executable of one of the targets
+func isModuleProcess(targets []*target, p Process) bool {
+	for _, t := range targets {
+		if t.isModuleProcess(p) {
+			return true
+		}
+	}
+	return false
+}
+
+//scannedProcess is a module process found by a scan, with its module and the targets it matches
+type scannedProcess struct {
+	p       Process
+	info    ModuleInfo
+	matches map[*target]bool
+}
+
+//checkAppengineModuleProcess look after the Appengine module processes and push the latest new PID of each target into its channel.
+//It returns the PIDs of the module processes.
+func checkAppengineModuleProcess(targets []*target) (map[int]bool, error) {
 	processes, err := processes()
 	if err != nil {
-		log.Fatalln(err.Error())
+		return nil, err
 	}
 
-	// check each process
-	pchan := make(chan int)
+	// check each process against each target
+	pchan := make(chan scannedProcess)
+	alive := map[int]bool{}
+	modulePids := map[int]bool{}
 	go func() {
 		var wg sync.WaitGroup
 		defer close(pchan)
 		for _, p := range processes {
-			if p.Executable() == "_go_app" {
+			alive[p.Pid()] = true
+			if isModuleProcess(targets, p) {
+				modulePids[p.Pid()] = true
 				wg.Add(1)
-				go func(pid int) {
+				go func(p Process) {
 					defer wg.Done()
-					if len(magicKey) == 0 || binaryContainsMagicKey(pid, magicKey) {
-						pchan <- pid
+					m := scannedProcess{p: p, info: identifyModule(p), matches: map[*target]bool{}}
+					for _, t := range targets {
+						m.matches[t] = t.matches(p, m.info)
 					}
-				}(p.Pid())
+					pchan <- m
+				}(p)
 			}
 		}
 		wg.Wait()
 	}()
 
-	//build the slice of PIDs
-	pids := sort.IntSlice{}
-	for pid := range pchan {
-		pids = append(pids, pid)
+	found := []*scannedProcess{}
+	for m := range pchan {
+		m := m
+		found = append(found, &m)
 	}
 
-	// keep the youngest one
-	if len(pids) > 0 {
-		if len(pids) == 1 {
-			if pids[0] == DebuggedPID { // already attached to that one
-				return
-			}
-		}
-		PidChan <- getRecentProcess(pids)
-	}
-}
+	pruneMagicKeyCache(alive)
 
-func waitForFreePort() {
-	var errCon error
-	var conn net.Conn
-	for errCon == nil {
-		conn, errCon = net.Dial("tcp", fmt.Sprintf(":%d", port))
-		if errCon == nil {
-			log.Println("Old server still listening.")
-			conn.Close()
-			time.Sleep(1 * time.Second)
-		}
+	for _, t := range targets {
+		candidates, discovered := t.discover(found)
+		t.setDiscovered(discovered)
+		t.dispatch(candidates, discovered)
 	}
+	return modulePids, nil
 }
 
-func attachDelveServer(attachPid int) chan bool {
-	stopChan := make(chan bool)
-	var wgServerRunning sync.WaitGroup
-	wgServerRunning.Add(1)
-	go func() {
-		defer close(stopChan)
-
-		// Make a TCP listener
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-		for err != nil {
-			log.Printf("Couldn't start listener: %s\n", err)
-			time.Sleep(1 * time.Second)
-		}
-		defer listener.Close()
-
-		// Create and start a debugger server
-		server := rpccommon.NewServer(&service.Config{
-			Listener:    listener,
-			ProcessArgs: []string{},
-			AttachPid:   attachPid,
-			AcceptMulti: true,
-		}, true)
-		if err := server.Run(); err != nil {
-			log.Println(err.Error())
-		} else {
-			defer server.Stop(false)
-		}
-		wgServerRunning.Done()
-		<-stopChan
-	}()
-
-	//wait for the server to be running
-	wgServerRunning.Wait()
-	return stopChan
-}
-
-//getRecentProcess within these PIDs which one is the latest one ?
-func getRecentProcess(pids sort.IntSlice) int {
-	if len(pids) == 0 {
-		return 0
-	}
-	tmax := uint64(0)
-	pid := 0
-	for _, p := range pids {
-		t, zombie := getProcessStartTime(p)
-		if zombie {
+//getRecentProcess within these processes which one is the latest one ?
+func getRecentProcess(processes []Process) ProcessIdentity {
+	recent := ProcessIdentity{}
+	for _, p := range processes {
+		if p.Zombie() {
 			continue
 		}
-		if t > tmax {
-			pid = p
-			tmax = t
+		if id := p.Identity(); id.StartTime > recent.StartTime {
+			recent = id
 		}
 	}
-	return pid
+	return recent
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultMatcher selects the module binaries started by dev_appserver
+const defaultMatcher = "name:_go_app"
+
+// maxParentDepth limits the walk up the parent processes
+const maxParentDepth = 16
+
+// lookupProcess finds the parent processes walked by ParentMatcher
+var lookupProcess = findProcess
+
+// the operators of the matcher expressions are surrounded by spaces, or at an
+// end of the expression, so that the regexps of the matchers may hold && and ||
+var (
+	orOperator  = regexp.MustCompile(`(^|\s+)\|\|(\s+|$)`)
+	andOperator = regexp.MustCompile(`(^|\s+)&&(\s+|$)`)
+)
+
+// ProcessMatcher selects the processes running a module
+type ProcessMatcher interface {
+	// Match returns true if the process runs a module
+	Match(p Process) bool
+	// String returns the matcher expression
+	String() string
+}
+
+// NameMatcher matches the executable name exactly
+type NameMatcher struct {
+	Name string
+}
+
+// Match implements ProcessMatcher
+func (m NameMatcher) Match(p Process) bool {
+	return p.Executable() == m.Name
+}
+
+func (m NameMatcher) String() string {
+	return "name:" + m.Name
+}
+
+// NameRegexpMatcher matches a regexp on the executable name
+type NameRegexpMatcher struct {
+	Regexp *regexp.Regexp
+}
+
+// Match implements ProcessMatcher
+func (m NameRegexpMatcher) Match(p Process) bool {
+	return m.Regexp.MatchString(p.Executable())
+}
+
+func (m NameRegexpMatcher) String() string {
+	return "name-re:" + m.Regexp.String()
+}
+
+// ExeRegexpMatcher matches a regexp on the full path of the executable
+type ExeRegexpMatcher struct {
+	Regexp *regexp.Regexp
+}
+
+// Match implements ProcessMatcher
+func (m ExeRegexpMatcher) Match(p Process) bool {
+	path, err := p.ExePath()
+	return err == nil && m.Regexp.MatchString(path)
+}
+
+func (m ExeRegexpMatcher) String() string {
+	return "exe-re:" + m.Regexp.String()
+}
+
+// ParentMatcher matches the processes having an ancestor whose command line
+// runs the given program, for example dev_appserver.py
+type ParentMatcher struct {
+	Program string
+}
+
+// Match implements ProcessMatcher
+func (m ParentMatcher) Match(p Process) bool {
+	ppid := p.PPid()
+	for depth := 0; depth < maxParentDepth && ppid > 1; depth++ {
+		parent, err := lookupProcess(ppid)
+		if err != nil {
+			return false
+		}
+		if cmdline, err := parent.Cmdline(); err == nil && runsProgram(cmdline, m.Program) {
+			return true
+		}
+		ppid = parent.PPid()
+	}
+	return false
+}
+
+func (m ParentMatcher) String() string {
+	return "parent:" + m.Program
+}
+
+// runsProgram returns true if one of the first arguments of the command line
+// is the program, the interpreter comes first for the scripts
+func runsProgram(cmdline []string, program string) bool {
+	for i, arg := range cmdline {
+		if i > 2 {
+			break
+		}
+		if filepath.Base(arg) == program {
+			return true
+		}
+	}
+	return false
+}
+
+// CmdlineMatcher matches a substring of the command line
+type CmdlineMatcher struct {
+	Substring string
+}
+
+// Match implements ProcessMatcher
+func (m CmdlineMatcher) Match(p Process) bool {
+	cmdline, err := p.Cmdline()
+	return err == nil && strings.Contains(strings.Join(cmdline, " "), m.Substring)
+}
+
+func (m CmdlineMatcher) String() string {
+	return "cmdline:" + m.Substring
+}
+
+// AllMatcher matches the processes matched by all its matchers
+type AllMatcher []ProcessMatcher
+
+// Match implements ProcessMatcher
+func (m AllMatcher) Match(p Process) bool {
+	for _, matcher := range m {
+		if !matcher.Match(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m AllMatcher) String() string {
+	return joinMatchers(m, " && ")
+}
+
+// AnyMatcher matches the processes matched by one of its matchers
+type AnyMatcher []ProcessMatcher
+
+// Match implements ProcessMatcher
+func (m AnyMatcher) Match(p Process) bool {
+	for _, matcher := range m {
+		if matcher.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m AnyMatcher) String() string {
+	return joinMatchers(m, " || ")
+}
+
+func joinMatchers(matchers []ProcessMatcher, sep string) string {
+	s := make([]string, len(matchers))
+	for i, m := range matchers {
+		s[i] = m.String()
+	}
+	return strings.Join(s, sep)
+}
+
+// ParseMatcher parses a matcher expression: matchers combined with " && ",
+// which binds tighter, and " || ". The operators must be surrounded by spaces,
+// within a value they are part of it. The matchers are:
+//   name:<executable name>
+//   name-re:<regexp on the executable name>
+//   exe-re:<regexp on the executable path>
+//   parent:<program run by a parent process, for example dev_appserver.py>
+//   cmdline:<substring of the command line>
+func ParseMatcher(expr string) (ProcessMatcher, error) {
+	alternatives := AnyMatcher{}
+	for _, alternative := range orOperator.Split(strings.TrimSpace(expr), -1) {
+		all := AllMatcher{}
+		for _, term := range andOperator.Split(alternative, -1) {
+			m, err := parseMatcherTerm(strings.TrimSpace(term))
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, m)
+		}
+		if len(all) == 1 {
+			alternatives = append(alternatives, all[0])
+		} else {
+			alternatives = append(alternatives, all)
+		}
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return alternatives, nil
+}
+
+func parseMatcherTerm(term string) (ProcessMatcher, error) {
+	i := strings.Index(term, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid matcher %q, expecting kind:value", term)
+	}
+	kind, value := term[:i], term[i+1:]
+	if len(value) == 0 {
+		return nil, fmt.Errorf("invalid matcher %q, the value is empty", term)
+	}
+	switch kind {
+	case "name":
+		return NameMatcher{Name: value}, nil
+	case "name-re", "exe-re":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid matcher %q: %s", term, err)
+		}
+		if kind == "name-re" {
+			return NameRegexpMatcher{Regexp: re}, nil
+		}
+		return ExeRegexpMatcher{Regexp: re}, nil
+	case "parent":
+		return ParentMatcher{Program: value}, nil
+	case "cmdline":
+		return CmdlineMatcher{Substring: value}, nil
+	}
+	return nil, fmt.Errorf("invalid matcher %q, unknown kind %q", term, kind)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+// fakeProcess is a Process whose metadata is given by the test
+type fakeProcess struct {
+	pid     int
+	ppid    int
+	start   uint64
+	zombie  bool
+	exe     string
+	cmdline []string
+}
+
+func (p *fakeProcess) Pid() int           { return p.pid }
+func (p *fakeProcess) PPid() int          { return p.ppid }
+func (p *fakeProcess) Executable() string { return regexp.MustCompile(`[^/]*$`).FindString(p.exe) }
+func (p *fakeProcess) StartTime() uint64  { return p.start }
+func (p *fakeProcess) Zombie() bool       { return p.zombie }
+func (p *fakeProcess) Identity() ProcessIdentity {
+	return ProcessIdentity{Pid: p.pid, StartTime: p.start}
+}
+func (p *fakeProcess) ExePath() (string, error)   { return p.exe, nil }
+func (p *fakeProcess) Cmdline() ([]string, error) { return p.cmdline, nil }
+
+// fakeProcesses replaces the lookup of the parent processes, it returns a
+// function restoring it
+func fakeProcesses(processes ...*fakeProcess) func() {
+	byPid := map[int]*fakeProcess{}
+	for _, p := range processes {
+		byPid[p.pid] = p
+	}
+	lookupProcess = func(pid int) (Process, error) {
+		if p, ok := byPid[pid]; ok {
+			return p, nil
+		}
+		return nil, errors.New("Process not found")
+	}
+	return func() { lookupProcess = findProcess }
+}
+
+func TestMatchers(t *testing.T) {
+	defer fakeProcesses(
+		&fakeProcess{pid: 10, ppid: 1, exe: "/usr/bin/python", cmdline: []string{"python", "/sdk/dev_appserver.py", "app.yaml"}},
+		&fakeProcess{pid: 11, ppid: 10, exe: "/bin/sh", cmdline: []string{"sh", "-c", "run"}},
+	)()
+	app := &fakeProcess{pid: 12, ppid: 11, exe: "/tmp/tmpXYZ/_go_app", cmdline: []string{"/tmp/tmpXYZ/_go_app", "--port", "8080"}}
+	other := &fakeProcess{pid: 20, ppid: 1, exe: "/usr/bin/myapp", cmdline: []string{"myapp"}}
+
+	tests := []struct {
+		expr  string
+		app   bool
+		other bool
+	}{
+		{"name:_go_app", true, false},
+		{"name-re:^my", false, true},
+		{"exe-re:^/tmp/.*/_go_app$", true, false},
+		{"parent:dev_appserver.py", true, false},
+		{"cmdline:--port 8080", true, false},
+		{"name:_go_app && parent:dev_appserver.py", true, false},
+		{"name:_go_app && cmdline:--port 9090", false, false},
+		{"name:myapp || cmdline:--port 8080", true, true},
+		// && binds tighter than ||
+		{"name:myapp || name:_go_app && cmdline:9090", false, true},
+		{"name:_go_app && cmdline:9090 || name:myapp", false, true},
+		{"name:nothing && name:myapp || name:_go_app", true, false},
+		// the operators are part of a regexp when they are not surrounded by spaces
+		{"name-re:^(myapp||other)$", false, true},
+		{"exe-re:_go_app$||^/usr/bin/", true, true},
+	}
+	for _, test := range tests {
+		m, err := ParseMatcher(test.expr)
+		if err != nil {
+			t.Errorf("ParseMatcher(%q): %s", test.expr, err)
+			continue
+		}
+		if got := m.Match(app); got != test.app {
+			t.Errorf("%q matches the module process: %v, want %v", test.expr, got, test.app)
+		}
+		if got := m.Match(other); got != test.other {
+			t.Errorf("%q matches the other process: %v, want %v", test.expr, got, test.other)
+		}
+	}
+}
+
+func TestParseMatcherString(t *testing.T) {
+	tests := []struct {
+		expr   string
+		parsed string
+	}{
+		{"name:_go_app", "name:_go_app"},
+		{"  name:a   &&  name:b || name:c ", "name:a && name:b || name:c"},
+		{"name-re:^(a||b)$ && cmdline:x&&y", "name-re:^(a||b)$ && cmdline:x&&y"},
+	}
+	for _, test := range tests {
+		m, err := ParseMatcher(test.expr)
+		if err != nil {
+			t.Errorf("ParseMatcher(%q): %s", test.expr, err)
+			continue
+		}
+		if m.String() != test.parsed {
+			t.Errorf("ParseMatcher(%q) = %q, want %q", test.expr, m.String(), test.parsed)
+		}
+	}
+}
+
+func TestParseMatcherErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"_go_app",
+		"name:",
+		"name:a || ",
+		"name:a && || name:b",
+		"size:12",
+		"name-re:(",
+	} {
+		if m, err := ParseMatcher(expr); err == nil {
+			t.Errorf("ParseMatcher(%q) = %s, want an error", expr, m)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// moduleEnvNames environment variables giving the name of the module, by order of preference
+var moduleEnvNames = []string{"GAE_MODULE_NAME", "CURRENT_MODULE_ID", "GAE_SERVICE"}
+
+// versionEnvNames environment variables giving the version of the module, by order of preference
+var versionEnvNames = []string{"GAE_MODULE_VERSION", "CURRENT_VERSION_ID", "GAE_VERSION"}
+
+// processMeta metadata read from the system for a process
+type processMeta struct {
+	Cmdline []string
+	Environ map[string]string
+	Cwd     string
+}
+
+// ModuleInfo identifies the Appengine module run by a process
+type ModuleInfo struct {
+	Name    string
+	Version string
+	Dir     string
+	// Source is the directory of the module yaml file given to dev_appserver
+	Source string
+	// Instance is the index of the process among the instances of its target,
+	// see instanceSlots; -1 when unknown
+	Instance int
+}
+
+// Known returns true if the module could be identified from the process metadata
+func (m ModuleInfo) Known() bool {
+	return len(m.Name) > 0
+}
+
+func (m ModuleInfo) String() string {
+	if !m.Known() {
+		return "unknown module"
+	}
+	if len(m.Version) == 0 {
+		return m.Name
+	}
+	return m.Name + ":" + m.Version
+}
+
+// Label describes the module, its instance and its source for the logs
+func (m ModuleInfo) Label() string {
+	label := m.String()
+	if m.Instance >= 0 {
+		label += fmt.Sprintf(" instance %d", m.Instance)
+	}
+	if len(m.Source) > 0 {
+		label += " in " + m.Source
+	}
+	return label
+}
+
+// Matches returns true if the module is selected by the selector. The selector
+// is either a module name or name:version.
+func (m ModuleInfo) Matches(selector string) bool {
+	if !m.Known() || len(selector) == 0 {
+		return false
+	}
+	name, version := selector, ""
+	if i := strings.Index(selector, ":"); i >= 0 {
+		name, version = selector[:i], selector[i+1:]
+	}
+	if name != m.Name {
+		return false
+	}
+	// CURRENT_VERSION_ID is "version.deployment", compare the major part only
+	return len(version) == 0 || version == m.Version || strings.HasPrefix(m.Version, version+".")
+}
+
+// identifyModule builds the module information of the process from its
+// environment, its working directory and the arguments of its parent dev_appserver.
+func identifyModule(p Process) ModuleInfo {
+	info := ModuleInfo{Instance: -1}
+	meta, err := processMetadata(p.Pid())
+	if err != nil {
+		return info
+	}
+	info.Dir = meta.Cwd
+	info.Name = firstEnv(meta.Environ, moduleEnvNames)
+	info.Version = firstEnv(meta.Environ, versionEnvNames)
+
+	// a module launched by the wrapper is a grandchild of dev_appserver
+	ppid := p.PPid()
+	if wrapper, err := strconv.Atoi(meta.Environ[wrapperEnv]); err == nil && wrapper == ppid {
+		if parent, err := findProcess(ppid); err == nil {
+			ppid = parent.PPid()
+		}
+	}
+
+	// look for the module yaml file given to dev_appserver: the one of the
+	// module name if known, the one in the working directory otherwise
+	parent, err := processMetadata(ppid)
+	if err != nil || !isDevAppserver(parent.Cmdline) {
+		return info
+	}
+	for _, path := range moduleYamlFiles(parent) {
+		if !info.Known() && len(info.Dir) > 0 && filepath.Clean(filepath.Dir(path)) != filepath.Clean(info.Dir) {
+			continue
+		}
+		name, version, err := readModuleYaml(path)
+		if err != nil || (info.Known() && name != info.Name) {
+			continue
+		}
+		info.Name = name
+		if len(info.Version) == 0 {
+			info.Version = version
+		}
+		info.Source = filepath.Dir(path)
+		return info
+	}
+	return info
+}
+
+// moduleYamlFiles returns the module yaml files given to dev_appserver, as
+// files or as directories holding an app.yaml
+func moduleYamlFiles(devAppserver *processMeta) []string {
+	files := []string{}
+	for _, arg := range devAppserver.Cmdline[1:] {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		path := arg
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(devAppserver.Cwd, path)
+		}
+		if isYamlFile(arg) {
+			files = append(files, path)
+			continue
+		}
+		for _, name := range []string{"app.yaml", "app.yml"} {
+			if info, err := os.Stat(filepath.Join(path, name)); err == nil && info.Mode().IsRegular() {
+				files = append(files, filepath.Join(path, name))
+				break
+			}
+		}
+	}
+	return files
+}
+
+func firstEnv(env map[string]string, names []string) string {
+	for _, name := range names {
+		if v := env[name]; len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+func isDevAppserver(cmdline []string) bool {
+	for _, arg := range cmdline {
+		if strings.Contains(filepath.Base(arg), "dev_appserver") {
+			return true
+		}
+	}
+	return false
+}
+
+func isYamlFile(arg string) bool {
+	return !strings.HasPrefix(arg, "-") && (strings.HasSuffix(arg, ".yaml") || strings.HasSuffix(arg, ".yml"))
+}
+
+// readModuleYaml reads the module (or service) name and version declared in
+// an app.yaml like file. Only top level keys are considered.
+func readModuleYaml(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	name, version := "", ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+		switch strings.TrimSpace(line[:i]) {
+		case "module", "service":
+			name = value
+		case "version":
+			version = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if len(name) == 0 {
+		name = "default"
+	}
+	return name, version, nil
+}
+
+// magicKeyCacheEntry identifies a binary scan, a binary doesn't change for a given process
+type magicKeyCacheEntry struct {
+	process ProcessIdentity
+	key     string
+}
+
+// magicKeyCache keeps the result of the binary scans
+var magicKeyCache = struct {
+	sync.Mutex
+	m map[magicKeyCacheEntry]bool
+}{m: map[magicKeyCacheEntry]bool{}}
+
+// matchesKey returns true if the process is identified by the key: the key is
+// compared to the module name/version and, only when the module is unknown,
+// searched in the binary.
+func matchesKey(p Process, info ModuleInfo, key string) bool {
+	if len(key) == 0 {
+		return true
+	}
+	if info.Known() {
+		return info.Matches(key)
+	}
+
+	entry := magicKeyCacheEntry{process: p.Identity(), key: key}
+	magicKeyCache.Lock()
+	found, ok := magicKeyCache.m[entry]
+	magicKeyCache.Unlock()
+	if ok {
+		return found
+	}
+
+	found = binaryContainsMagicKey(p.Pid(), key)
+	magicKeyCache.Lock()
+	magicKeyCache.m[entry] = found
+	magicKeyCache.Unlock()
+	return found
+}
+
+// pruneMagicKeyCache forgets the binary scans of the processes that are gone
+func pruneMagicKeyCache(alive map[int]bool) {
+	magicKeyCache.Lock()
+	defer magicKeyCache.Unlock()
+	for entry := range magicKeyCache.m {
+		if !alive[entry.process.Pid] {
+			delete(magicKeyCache.m, entry)
+		}
+	}
+}
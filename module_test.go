@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadModuleYaml(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delveappengine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		name    string
+		version string
+	}{
+		{"runtime: go\napi_version: go1\n", "default", ""},
+		{"module: frontend\nversion: v2\nruntime: go\n", "frontend", "v2"},
+		{"service: \"worker\" # the service name\nversion: 'v1'\n", "worker", "v1"},
+		// only the top level keys are read
+		{"runtime: go\nhandlers:\n- url: /.*\n  script: _go_app\n  module: nested\nenv_variables:\n  version: nested\n", "default", ""},
+		{"# module: commented\nmodule: admin\n", "admin", ""},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "app.yaml")
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		name, version, err := readModuleYaml(path)
+		if err != nil {
+			t.Errorf("test %d: %s", i, err)
+			continue
+		}
+		if name != test.name || version != test.version {
+			t.Errorf("test %d: readModuleYaml = %q, %q, want %q, %q", i, name, version, test.name, test.version)
+		}
+	}
+
+	if _, _, err := readModuleYaml(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("missing yaml file read without error")
+	}
+}
+
+func TestMatchesKey(t *testing.T) {
+	defer pruneMagicKeyCache(map[int]bool{})
+	p := &fakeProcess{pid: 1 << 30, start: 1}
+	scanned := func() bool {
+		magicKeyCache.Lock()
+		defer magicKeyCache.Unlock()
+		_, ok := magicKeyCache.m[magicKeyCacheEntry{process: p.Identity(), key: "frontend"}]
+		return ok
+	}
+
+	if !matchesKey(p, ModuleInfo{Name: "worker"}, "") {
+		t.Error("no key must match every module")
+	}
+	if !matchesKey(p, ModuleInfo{Name: "frontend", Version: "v2"}, "frontend") {
+		t.Error("the key must match the module name")
+	}
+	// an identified module is not searched for the key
+	if matchesKey(p, ModuleInfo{Name: "worker"}, "frontend") || scanned() {
+		t.Error("the binary of an identified module was searched for the key")
+	}
+	if matchesKey(p, ModuleInfo{}, "frontend") || !scanned() {
+		t.Error("the binary of an unknown module must be searched for the key")
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 // Process is the generic interface that is implemented on every platform
 // and provides common operations for processes.
 type Process interface {
@@ -18,4 +20,60 @@ type Process interface {
 
 	// Zombie returns if the process is a zombie process
 	Zombie() bool
+
+	// Identity returns the identity of the process, which is not reused
+	// when the kernel gives the PID to a new process
+	Identity() ProcessIdentity
+
+	// ExePath returns the full path of the executable
+	ExePath() (string, error)
+
+	// Cmdline returns the command line arguments, the program first
+	Cmdline() ([]string, error)
+}
+
+// ProcessIdentity identifies a process across PID reuse
+type ProcessIdentity struct {
+	Pid int
+	// StartTime of the process since boot, in the unit of the platform
+	StartTime uint64
+	// Inode of the executable, 0 when it can't be read
+	Inode uint64
+}
+
+// IsZero returns true for the identity of no process
+func (id ProcessIdentity) IsZero() bool {
+	return id.Pid == 0
+}
+
+// Same returns true if both identities are the same process. The inode is
+// only compared when it is known on both sides.
+func (id ProcessIdentity) Same(other ProcessIdentity) bool {
+	if id.Pid != other.Pid || id.StartTime != other.StartTime {
+		return false
+	}
+	return id.Inode == 0 || other.Inode == 0 || id.Inode == other.Inode
+}
+
+func (id ProcessIdentity) String() string {
+	return fmt.Sprintf("PID %d (start %d, inode %d)", id.Pid, id.StartTime, id.Inode)
+}
+
+// currentIdentity returns the identity of the process that has the PID now
+func currentIdentity(pid int) (ProcessIdentity, error) {
+	p, err := findProcess(pid)
+	if err != nil {
+		return ProcessIdentity{}, err
+	}
+	return p.Identity(), nil
+}
+
+// processEvent is a process life cycle event reported by the system
+type processEvent struct {
+	// Pid is the process ID of the process concerned by the event
+	Pid int
+	// Exec is true when the process executed a new binary, false when it exited
+	Exec bool
+	// Lost is true when events were dropped by the system: the processes must be scanned again
+	Lost bool
 }
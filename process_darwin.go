@@ -7,7 +7,6 @@ import "C"
 
 import (
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -57,6 +56,25 @@ func (p *DarwinProcess) Zombie() bool {
 	return p.zombie
 }
 
+// Identity returns the identity of the process, stable across PID reuse
+func (p *DarwinProcess) Identity() ProcessIdentity {
+	return ProcessIdentity{Pid: p.pid, StartTime: p.startTime, Inode: exeInode(p.binary)}
+}
+
+// ExePath returns the full path of the executable
+func (p *DarwinProcess) ExePath() (string, error) {
+	return getFullPath(p.pid)
+}
+
+// Cmdline returns the command line arguments, the program first
+func (p *DarwinProcess) Cmdline() ([]string, error) {
+	meta, err := processMetadata(p.pid)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Cmdline, nil
+}
+
 //export go_darwin_append_proc4
 func go_darwin_append_proc4(pid C.pid_t, ppid C.pid_t, comm *C.char, startTime C.long, isZombie C.int) {
 	proc := DarwinProcess{
@@ -74,26 +92,70 @@ func go_darwin_append_proc4(pid C.pid_t, ppid C.pid_t, comm *C.char, startTime C
 func getProcessStartTime(pid int) (uint64, bool) {
 	p, err := getProcess(pid)
 	if err != nil {
-		fmt.Println("process error:", err)
 		return 0, false
 	}
 	return p.StartTime(), p.Zombie()
 }
 
-func getProcess(pid int) (DarwinProcess, error) {
+func getProcess(pid int) (*DarwinProcess, error) {
 	processes, err := processes()
 	if err != nil {
-		fmt.Println("process error:", err)
-	} else {
-		for _, p := range processes {
-			if p.Pid() == pid {
-				return p, nil
-			}
+		return &DarwinProcess{}, err
+	}
+	for _, p := range processes {
+		if p.Pid() == pid {
+			return p.(*DarwinProcess), nil
 		}
 	}
 
-	return DarwinProcess{}, errors.New("Process not found")
+	return &DarwinProcess{}, errors.New("Process not found")
+}
+
+// findProcess returns the process with the given PID
+func findProcess(pid int) (Process, error) {
+	return getProcess(pid)
+}
+
+// processExePath returns the path of the executable of the process
+func processExePath(pid int) (string, error) {
+	return getFullPath(pid)
+}
+
+// exeInode returns the inode of the executable, 0 when unknown
+func exeInode(path string) uint64 {
+	var stat syscall.Stat_t
+	if !filepath.IsAbs(path) {
+		// only the name is known
+		return 0
+	}
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0
+	}
+	return stat.Ino
+}
+
+// tracerPidSupported is false on darwin: tracerPid can't tell the debugger of a process
+const tracerPidSupported = false
+
+// tracerPid returns the PID of the debugger tracing the process, it is not
+// known on darwin: 0
+func tracerPid(pid int) int {
+	return 0
+}
+
+// reapProcess collects the exit status of a dead traced process
+func reapProcess(pid int) (int, bool) {
+	var ws syscall.WaitStatus
+	wpid, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+	if err != nil || wpid != pid || !(ws.Exited() || ws.Signaled()) {
+		return 0, false
+	}
+	if ws.Signaled() {
+		return 128 + int(ws.Signal()), true
+	}
+	return ws.ExitStatus(), true
 }
+
 func binaryContainsMagicKey(pid int, key string) bool {
 	for _, proc := range darwinProcs {
 		if proc.pid == pid {
@@ -109,23 +171,81 @@ func binaryContainsMagicKey(pid int, key string) bool {
 	return false
 }
 
-func processes() ([]DarwinProcess, error) {
+func processes() ([]Process, error) {
 	darwinLock.Lock()
 	defer darwinLock.Unlock()
 	darwinProcs = make([]DarwinProcess, 0, 50)
 
 	_, err := C.darwinProcesses()
 	if err != nil {
-		return nil, err
+		return nil, &ScanError{Err: err}
 	}
 
+	result := make([]Process, 0, len(darwinProcs))
 	for id, proc := range darwinProcs {
 		if path, err := getFullPath(proc.pid); err == nil {
 			darwinProcs[id].binary = path
 		}
+		p := darwinProcs[id]
+		result = append(result, &p)
+	}
+
+	return result, nil
+}
+
+// processMetadata reads the command line and the environment of the process.
+// The working directory is not available through sysctl and is left empty.
+func processMetadata(pid int) (*processMeta, error) {
+	buf, err := sysctlProcArgs(49 /* KERN_PROCARGS2 */, pid)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 4 {
+		return nil, errors.New("Invalid process arguments")
+	}
+
+	// argc, followed by the exec path, the arguments and the environment,
+	// all null terminated (the exec path is padded with extra nulls)
+	argc := int(*(*int32)(unsafe.Pointer(&buf[0])))
+	fields := []string{}
+	for _, s := range strings.Split(string(buf[4:]), "\x00") {
+		if len(s) > 0 {
+			fields = append(fields, s)
+		}
 	}
+	if len(fields) > 0 {
+		fields = fields[1:] // exec path
+	}
+	meta := &processMeta{Environ: map[string]string{}}
+	for i, field := range fields {
+		if i < argc {
+			meta.Cmdline = append(meta.Cmdline, field)
+		} else if j := strings.Index(field, "="); j > 0 {
+			meta.Environ[field[:j]] = field[j+1:]
+		}
+	}
+	return meta, nil
+}
 
-	return darwinProcs, nil
+// sysctlProcArgs returns the raw KERN_PROCARGS or KERN_PROCARGS2 buffer of the process
+func sysctlProcArgs(name int32, pid int) ([]byte, error) {
+	mib := [3]int32{1 /* CTL_KERN */, name, int32(pid)}
+
+	n := uintptr(0)
+	// Get length.
+	_, _, errNum := syscall.Syscall6(syscall.SYS___SYSCTL, uintptr(unsafe.Pointer(&mib[0])), 3, 0, uintptr(unsafe.Pointer(&n)), 0, 0)
+	if errNum != 0 {
+		return nil, errNum
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, n)
+	_, _, errNum = syscall.Syscall6(syscall.SYS___SYSCTL, uintptr(unsafe.Pointer(&mib[0])), 3, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0, 0)
+	if errNum != 0 {
+		return nil, errNum
+	}
+	return buf[:n], nil
 }
 
 func getFullPath(pid int) (string, error) {
@@ -3,10 +3,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/mitchellh/go-ps"
 )
@@ -57,14 +60,63 @@ func (l *LinuxProcess) Zombie() bool {
 	return l.zombie
 }
 
+// Identity returns the identity of the process, stable across PID reuse
+func (l *LinuxProcess) Identity() ProcessIdentity {
+	return ProcessIdentity{Pid: l.Pid(), StartTime: l.StartTime(), Inode: exeInode(l.Pid())}
+}
+
+// ExePath returns the full path of the executable
+func (l *LinuxProcess) ExePath() (string, error) {
+	return processExePath(l.Pid())
+}
+
+// Cmdline returns the command line arguments, the program first
+func (l *LinuxProcess) Cmdline() ([]string, error) {
+	return processCmdline(l.Pid())
+}
+
+// findProcess returns the process with the given PID
+func findProcess(pid int) (Process, error) {
+	p, err := ps.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, errors.New("Process not found")
+	}
+	return &LinuxProcess{done: false, p: p}, nil
+}
+
+// processes lists the processes. The processes that exit while they are listed
+// are left out, the ones that can't be read are skipped and reported.
 func processes() ([]Process, error) {
-	result := []Process{}
-	ps, err := ps.Processes()
+	d, err := os.Open("/proc")
 	if err != nil {
-		return result, err
+		return nil, &ScanError{Err: err}
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, &ScanError{Err: err}
 	}
 
-	for _, p := range ps {
+	result := []Process{}
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		p, err := ps.FindProcess(pid)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				processSkipped(&ProcessReadError{Pid: pid, Err: err})
+			}
+			continue
+		}
+		if p == nil {
+			// gone
+			continue
+		}
 		result = append(result, &LinuxProcess{done: false, p: p})
 	}
 	return result, nil
@@ -81,16 +133,68 @@ func getProcessStartTime(pid int) (uint64, bool) {
 	// First, parse out the image name (can contain space char)
 	data := string(dataBytes)
 	binStart := strings.IndexRune(data, '(') + 1
-	binEnd := strings.IndexRune(data[binStart:], ')')
+	binEnd := strings.LastIndex(data[binStart:], ")")
+	if binStart == 0 || binEnd < 0 || binStart+binEnd+2 > len(data) {
+		return 0, false
+	}
 
 	fields := strings.Split(data[binStart+binEnd+2:], " ")
 	// http://man7.org/linux/man-pages/man5/proc.5.html
 	//(field 22 is starttime (index 21)) and we have already shifted by two elements
+	if len(fields) <= 21-2 {
+		return 0, false
+	}
 
 	startTime, _ := strconv.ParseUint(fields[21-2], 10, 64)
 	return startTime, fields[0] == "Z"
 }
 
+// processExePath returns the path of the executable of the process
+func processExePath(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+}
+
+// exeInode returns the inode of the executable of the process, 0 when unknown.
+// The link is followed even if the executable was deleted or replaced.
+func exeInode(pid int) uint64 {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(fmt.Sprintf("/proc/%d/exe", pid), &stat); err != nil {
+		return 0
+	}
+	return stat.Ino
+}
+
+// tracerPidSupported is true when tracerPid tells the debugger of a process
+const tracerPidSupported = true
+
+// tracerPid returns the PID of the debugger tracing the process, 0 if none
+func tracerPid(pid int) int {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "TracerPid:") {
+			tracer, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "TracerPid:")))
+			return tracer
+		}
+	}
+	return 0
+}
+
+// reapProcess collects the exit status of a dead traced process
+func reapProcess(pid int) (int, bool) {
+	var ws syscall.WaitStatus
+	wpid, err := syscall.Wait4(pid, &ws, syscall.WNOHANG|syscall.WALL, nil)
+	if err != nil || wpid != pid || !(ws.Exited() || ws.Signaled()) {
+		return 0, false
+	}
+	if ws.Signaled() {
+		return 128 + int(ws.Signal()), true
+	}
+	return ws.ExitStatus(), true
+}
+
 func binaryContainsMagicKey(pid int, key string) bool {
 	exePath := fmt.Sprintf("/proc/%d/exe", pid)
 	dataBytes, err := ioutil.ReadFile(exePath)
@@ -99,3 +203,47 @@ func binaryContainsMagicKey(pid int, key string) bool {
 	}
 	return strings.Contains(string(dataBytes), key)
 }
+
+// processMetadata reads the command line, the environment and the working directory of the process
+func processMetadata(pid int) (*processMeta, error) {
+	cmdline, err := processCmdline(pid)
+	if err != nil {
+		return nil, err
+	}
+	meta := &processMeta{
+		Cmdline: cmdline,
+		Environ: map[string]string{},
+	}
+
+	// environ and cwd are only readable for our own processes (or as root)
+	if environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid)); err == nil {
+		for _, kv := range splitNullTerminated(environ) {
+			if i := strings.Index(kv, "="); i > 0 {
+				meta.Environ[kv[:i]] = kv[i+1:]
+			}
+		}
+	}
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err == nil {
+		meta.Cwd = cwd
+	}
+	return meta, nil
+}
+
+// processCmdline reads the command line of the process
+func processCmdline(pid int) ([]string, error) {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	return splitNullTerminated(cmdline), nil
+}
+
+func splitNullTerminated(data []byte) []string {
+	result := []string{}
+	for _, s := range strings.Split(string(data), "\x00") {
+		if len(s) > 0 {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// errNoBackend is returned to the calls made while no module process is attached
+var errNoBackend = errors.New("delveAppengine: no module process attached, waiting for the module to start")
+
+// errAuthRequired is returned to the calls of a client that didn't authenticate first
+var errAuthRequired = errors.New("authentication required")
+
+// errInvalidToken is returned when a client authenticates with a wrong token
+var errInvalidToken = errors.New("invalid token")
+
+// errBackendSwapped is returned to the calls in flight when the module process is replaced
+var errBackendSwapped = errors.New("delveAppengine: the module process was replaced while the call was in flight")
+
+// lazyAttachTimeout is how long the calls of a client wait for the module
+// process to be attached in lazy mode
+const lazyAttachTimeout = 30 * time.Second
+
+// rpcProxy owns the public port of a target and forwards the JSON-RPC calls of
+// the clients to the Delve server of the current module process. The client
+// connections are kept open when the module process, and so the Delve server, is replaced.
+type rpcProxy struct {
+	listener   net.Listener
+	apiVersion int    // API version served by the backends by default
+	token      string // required from the clients and sent to the backends, if set
+
+	mu       sync.Mutex
+	backend  string        // address of the current Delve server, empty while none
+	ready    chan struct{} // closed while there is a backend
+	sessions map[*proxySession]bool
+	onClient func(delta int) // reports the client connections in lazy mode
+}
+
+// proxyRequest is a JSON-RPC request, only the fields needed for routing are decoded
+type proxyRequest struct {
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params"`
+	ID     *json.RawMessage `json:"id"`
+}
+
+// proxyResponse is a JSON-RPC response
+type proxyResponse struct {
+	ID     *json.RawMessage `json:"id"`
+	Result interface{}      `json:"result"`
+	Error  interface{}      `json:"error"`
+}
+
+// pendingCall is a call forwarded to the backend and waiting for its response
+type pendingCall struct {
+	method string
+	id     *json.RawMessage
+}
+
+// proxySession is a client connection and its connection to the current backend
+type proxySession struct {
+	proxy  *rpcProxy
+	client net.Conn
+
+	sending sync.Mutex // serializes the writes to the client
+	enc     *json.Encoder
+
+	mu         sync.Mutex
+	backend    net.Conn
+	backendEnc *json.Encoder
+	pending    map[string]pendingCall
+	apiVersion *json.RawMessage // params of the last SetApiVersion, replayed on each new backend
+	version    int
+	internalID uint64
+	counted    bool // the client was reported to onClient
+}
+
+func newRPCProxy(listener net.Listener, apiVersion int, token string) *rpcProxy {
+	if apiVersion < 2 {
+		apiVersion = 1
+	}
+	p := &rpcProxy{listener: listener, apiVersion: apiVersion, token: token, ready: make(chan struct{}), sessions: map[*proxySession]bool{}}
+	go p.serve()
+	return p
+}
+
+// lazy makes the calls of the clients wait for a backend, the connections and
+// disconnections of the clients are reported to onClient so that the process
+// is attached when needed
+func (p *rpcProxy) lazy(onClient func(delta int)) {
+	p.mu.Lock()
+	p.onClient = onClient
+	p.mu.Unlock()
+}
+
+func (p *rpcProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			log.Printf("Proxy stopped accepting connections: %s\n", err)
+			return
+		}
+		s := &proxySession{
+			proxy:   p,
+			client:  conn,
+			enc:     json.NewEncoder(conn),
+			pending: map[string]pendingCall{},
+			version: p.apiVersion,
+		}
+		p.mu.Lock()
+		p.sessions[s] = true
+		p.mu.Unlock()
+		go s.serve()
+	}
+}
+
+// setBackend switches the clients to the Delve server listening at addr, as
+// returned by backendAddr. The calls in flight on the previous server are failed. An empty address means
+// that there is no server anymore.
+func (p *rpcProxy) setBackend(addr string) {
+	p.mu.Lock()
+	if len(p.backend) == 0 && len(addr) > 0 {
+		close(p.ready)
+	} else if len(p.backend) > 0 && len(addr) == 0 {
+		p.ready = make(chan struct{})
+	}
+	p.backend = addr
+	sessions := make([]*proxySession, 0, len(p.sessions))
+	for s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.mu.Unlock()
+
+	for _, s := range sessions {
+		s.dropBackend(errBackendSwapped)
+	}
+}
+
+func (p *rpcProxy) currentBackend() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.backend
+}
+
+// waitBackend waits for a backend in lazy mode, the process being attached
+// because the client connected
+func (p *rpcProxy) waitBackend() {
+	p.mu.Lock()
+	ready, lazy := p.ready, p.onClient != nil
+	p.mu.Unlock()
+	if !lazy {
+		return
+	}
+	select {
+	case <-ready:
+	case <-time.After(lazyAttachTimeout):
+	}
+}
+
+// Close stops listening and closes all the client connections
+func (p *rpcProxy) Close() error {
+	err := p.listener.Close()
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = map[*proxySession]bool{}
+	p.mu.Unlock()
+	for s := range sessions {
+		s.client.Close()
+	}
+	return err
+}
+
+func (s *proxySession) serve() {
+	defer func() {
+		s.proxy.mu.Lock()
+		delete(s.proxy.sessions, s)
+		onClient := s.proxy.onClient
+		s.proxy.mu.Unlock()
+		if onClient != nil && s.counted {
+			onClient(-1)
+		}
+		s.dropBackend(nil)
+		s.client.Close()
+	}()
+
+	authenticated := len(s.proxy.token) == 0
+	if authenticated {
+		s.connected()
+	}
+	dec := json.NewDecoder(s.client)
+	for {
+		var req proxyRequest
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				log.Printf("Proxy: %s\n", err)
+			}
+			return
+		}
+		if !authenticated {
+			// the first call must authenticate, it is answered by the proxy
+			if err := s.authenticate(&req); err != nil {
+				log.Printf("Proxy: closing the connection of %s: %s\n", s.client.RemoteAddr(), err)
+				s.reply(req.ID, nil, err)
+				return
+			}
+			s.reply(req.ID, struct{}{}, nil)
+			authenticated = true
+			s.connected()
+			continue
+		}
+		if req.Method == "RPCServer.SetApiVersion" {
+			s.recordAPIVersion(req.Params)
+		}
+		if err := s.forward(&req); err != nil {
+			if err == errNoBackend && req.Method == "RPCServer.SetApiVersion" {
+				// it will be replayed on the backend when the module is attached
+				s.reply(req.ID, struct{}{}, nil)
+				continue
+			}
+			s.reply(req.ID, nil, err)
+		}
+	}
+}
+
+// connected reports the client to onClient, in lazy mode
+func (s *proxySession) connected() {
+	s.proxy.mu.Lock()
+	onClient := s.proxy.onClient
+	s.proxy.mu.Unlock()
+	if onClient != nil {
+		s.counted = true
+		onClient(1)
+	}
+}
+
+// authenticate checks the token sent by the first call of the client
+func (s *proxySession) authenticate(req *proxyRequest) error {
+	if req.Method != "RPCServer.Authenticate" {
+		return errAuthRequired
+	}
+	var in []struct{ Token string }
+	if req.Params == nil || json.Unmarshal(*req.Params, &in) != nil || len(in) == 0 {
+		return errInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(in[0].Token), []byte(s.proxy.token)) != 1 {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// recordAPIVersion keeps the API version asked by the client to replay it on the next backends
+func (s *proxySession) recordAPIVersion(params *json.RawMessage) {
+	var in []struct{ APIVersion int }
+	if params == nil || json.Unmarshal(*params, &in) != nil || len(in) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiVersion = params
+	s.version = in[0].APIVersion
+	if s.version < 2 {
+		s.version = 1
+	}
+}
+
+// forward sends the request to the current backend, connecting to it first if needed
+func (s *proxySession) forward(req *proxyRequest) error {
+	s.proxy.waitBackend()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.backend == nil {
+		addr := s.proxy.currentBackend()
+		if len(addr) == 0 {
+			return errNoBackend
+		}
+		conn, err := dialBackend(addr)
+		if err != nil {
+			return fmt.Errorf("delveAppengine: couldn't reach the Delve server: %s", err)
+		}
+		s.backend = conn
+		s.backendEnc = json.NewEncoder(conn)
+		go s.readBackend(conn)
+
+		if len(s.proxy.token) > 0 {
+			params, _ := json.Marshal([]interface{}{map[string]string{"Token": s.proxy.token}})
+			if err := s.sendInternal("RPCServer.Authenticate", params); err != nil {
+				return err
+			}
+		}
+		// the API version is a setting of the server, replay it on the new one.
+		// It is set even if the client didn't ask for it: a module launched by
+		// the wrapper serves the default version of the wrapper.
+		if req.Method != "RPCServer.SetApiVersion" {
+			params := s.apiVersion
+			if params == nil {
+				version, _ := json.Marshal([]interface{}{map[string]int{"APIVersion": s.version}})
+				params = (*json.RawMessage)(&version)
+			}
+			if err := s.sendInternal("RPCServer.SetApiVersion", *params); err != nil {
+				return err
+			}
+		}
+	}
+
+	if req.ID != nil {
+		s.pending[string(*req.ID)] = pendingCall{method: req.Method, id: req.ID}
+	}
+	if err := s.backendEnc.Encode(req); err != nil {
+		if req.ID != nil {
+			delete(s.pending, string(*req.ID))
+		}
+		return err
+	}
+	return nil
+}
+
+// sendInternal sends a call of the proxy itself to the backend, its response is not forwarded
+func (s *proxySession) sendInternal(method string, params json.RawMessage) error {
+	s.internalID++
+	id := json.RawMessage(fmt.Sprintf(`"delveAppengine-%d"`, s.internalID))
+	return s.backendEnc.Encode(&proxyRequest{Method: method, Params: &params, ID: &id})
+}
+
+// readBackend forwards the responses of the backend to the client
+func (s *proxySession) readBackend(conn net.Conn) {
+	dec := json.NewDecoder(conn)
+	for {
+		var resp struct {
+			ID     *json.RawMessage `json:"id"`
+			Result *json.RawMessage `json:"result"`
+			Error  interface{}      `json:"error"`
+		}
+		if err := dec.Decode(&resp); err != nil {
+			s.mu.Lock()
+			current := s.backend == conn
+			s.mu.Unlock()
+			if current {
+				s.dropBackend(errBackendSwapped)
+			}
+			return
+		}
+		if resp.ID == nil {
+			continue
+		}
+
+		s.mu.Lock()
+		call, ok := s.pending[string(*resp.ID)]
+		delete(s.pending, string(*resp.ID))
+		s.mu.Unlock()
+		if !ok {
+			// response to a replayed call
+			if resp.Error != nil {
+				log.Printf("Proxy: internal call failed: %v\n", resp.Error)
+			}
+			continue
+		}
+		s.write(&proxyResponse{ID: call.id, Result: resp.Result, Error: resp.Error})
+	}
+}
+
+// dropBackend closes the connection to the backend and fails the calls in flight
+// with the reason. A nil reason means the client is gone and nothing is replied.
+func (s *proxySession) dropBackend(reason error) {
+	s.mu.Lock()
+	conn := s.backend
+	pending := s.pending
+	version := s.version
+	s.backend = nil
+	s.backendEnc = nil
+	s.pending = map[string]pendingCall{}
+	s.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	if reason == nil {
+		return
+	}
+	for _, call := range pending {
+		if call.method == "RPCServer.Command" {
+			// a continue/next/step can't complete, the process is gone
+			s.reply(call.id, exitedState(version), nil)
+			continue
+		}
+		s.reply(call.id, nil, reason)
+	}
+}
+
+// exitedState is the reply to a Command call when the process is gone, for the given API version
+func exitedState(version int) interface{} {
+	state := map[string]interface{}{"exited": true, "exitStatus": 0}
+	if version == 1 {
+		return state
+	}
+	return map[string]interface{}{"State": state}
+}
+
+func (s *proxySession) reply(id *json.RawMessage, result interface{}, err error) {
+	if id == nil {
+		return
+	}
+	resp := &proxyResponse{ID: id, Result: result}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	s.write(resp)
+}
+
+func (s *proxySession) write(resp *proxyResponse) {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	if err := s.enc.Encode(resp); err != nil {
+		log.Printf("Proxy: writing response: %s\n", err)
+	}
+}
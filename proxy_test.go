@@ -0,0 +1,401 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend is a JSON-RPC server standing for the Delve server of a module process
+type fakeBackend struct {
+	name     string
+	listener net.Listener
+
+	mu    sync.Mutex
+	calls []string
+	// entered receives the blocking calls when they arrive, release unblocks them
+	entered chan string
+	release chan bool
+}
+
+type FakeEmpty struct{}
+
+type FakeAuthIn struct{ Token string }
+
+type FakeVersionIn struct{ APIVersion int }
+
+type FakeState struct {
+	Backend string
+	Exited  bool `json:"exited"`
+}
+
+// fakeRPCServer serves the RPCServer methods of a fake backend
+type fakeRPCServer struct {
+	b *fakeBackend
+}
+
+func (s *fakeRPCServer) Authenticate(in FakeAuthIn, out *FakeEmpty) error {
+	s.b.record("Authenticate " + in.Token)
+	return nil
+}
+
+func (s *fakeRPCServer) SetApiVersion(in FakeVersionIn, out *FakeEmpty) error {
+	s.b.record("SetApiVersion " + string(rune('0'+in.APIVersion)))
+	return nil
+}
+
+func (s *fakeRPCServer) State(in FakeEmpty, out *FakeState) error {
+	s.b.record("State")
+	out.Backend = s.b.name
+	return nil
+}
+
+// Command blocks until released, like a continue
+func (s *fakeRPCServer) Command(in FakeEmpty, out *FakeState) error {
+	s.b.record("Command")
+	s.b.entered <- "Command"
+	<-s.b.release
+	out.Backend = s.b.name
+	return nil
+}
+
+// Stacktrace blocks until released
+func (s *fakeRPCServer) Stacktrace(in FakeEmpty, out *FakeState) error {
+	s.b.record("Stacktrace")
+	s.b.entered <- "Stacktrace"
+	<-s.b.release
+	out.Backend = s.b.name
+	return nil
+}
+
+func newFakeBackend(t *testing.T, name string) *fakeBackend {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBackend{name: name, listener: listener, entered: make(chan string, 1), release: make(chan bool)}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCServer", &fakeRPCServer{b: b}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// the requests are served in order, like the synchronous
+			// methods of Delve: the handshake of the proxy is pipelined
+			go func() {
+				codec := jsonrpc.NewServerCodec(conn)
+				for server.ServeRequest(codec) == nil {
+				}
+				codec.Close()
+			}()
+		}
+	}()
+	return b
+}
+
+func (b *fakeBackend) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *fakeBackend) record(call string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, call)
+}
+
+// received returns the calls received so far
+func (b *fakeBackend) received() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string{}, b.calls...)
+}
+
+// waitCalls waits for the backend to receive n calls
+func (b *fakeBackend) waitCalls(t *testing.T, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if calls := b.received(); len(calls) >= n {
+			return calls
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("backend %s: received %v, want %d calls", b.name, b.received(), n)
+	return nil
+}
+
+func (b *fakeBackend) close() {
+	b.listener.Close()
+}
+
+func newTestProxy(t *testing.T, apiVersion int, token string) *rpcProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRPCProxy(listener, apiVersion, token)
+}
+
+func dialProxy(t *testing.T, p *rpcProxy) *rpc.Client {
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jsonrpc.NewClient(conn)
+}
+
+// waitCall returns the result of the asynchronous call, failing after a timeout
+func waitCall(t *testing.T, call *rpc.Call) error {
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: no response", call.ServiceMethod)
+		return nil
+	}
+}
+
+func TestProxyForwards(t *testing.T) {
+	backend := newFakeBackend(t, "a")
+	defer backend.close()
+	p := newTestProxy(t, 1, "")
+	defer p.Close()
+	p.setBackend(backend.addr())
+
+	client := dialProxy(t, p)
+	defer client.Close()
+	var state FakeState
+	if err := client.Call("RPCServer.State", FakeEmpty{}, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Backend != "a" {
+		t.Errorf("state from backend %q, want a", state.Backend)
+	}
+	// the default API version of the target is set on the backend first
+	if calls := backend.received(); !reflect.DeepEqual(calls, []string{"SetApiVersion 1", "State"}) {
+		t.Errorf("backend received %v", calls)
+	}
+}
+
+func TestProxyNoBackend(t *testing.T) {
+	p := newTestProxy(t, 1, "")
+	defer p.Close()
+
+	client := dialProxy(t, p)
+	defer client.Close()
+	var state FakeState
+	err := client.Call("RPCServer.State", FakeEmpty{}, &state)
+	if err == nil || err.Error() != errNoBackend.Error() {
+		t.Errorf("call without backend: %v, want %v", err, errNoBackend)
+	}
+	// the API version asked before the attach is accepted, to be replayed
+	if err := client.Call("RPCServer.SetApiVersion", FakeVersionIn{APIVersion: 2}, &FakeEmpty{}); err != nil {
+		t.Errorf("SetApiVersion without backend: %s", err)
+	}
+}
+
+func TestProxyTokenHandshake(t *testing.T) {
+	backend := newFakeBackend(t, "a")
+	defer backend.close()
+	p := newTestProxy(t, 1, "secret")
+	defer p.Close()
+	p.setBackend(backend.addr())
+
+	// the first call must authenticate
+	client := dialProxy(t, p)
+	err := client.Call("RPCServer.State", FakeEmpty{}, &FakeState{})
+	if err == nil || err.Error() != errAuthRequired.Error() {
+		t.Errorf("call before authentication: %v, want %v", err, errAuthRequired)
+	}
+	client.Close()
+
+	client = dialProxy(t, p)
+	err = client.Call("RPCServer.Authenticate", FakeAuthIn{Token: "wrong"}, &FakeEmpty{})
+	if err == nil || err.Error() != errInvalidToken.Error() {
+		t.Errorf("authentication with a wrong token: %v, want %v", err, errInvalidToken)
+	}
+	client.Close()
+
+	client = dialProxy(t, p)
+	defer client.Close()
+	if err := client.Call("RPCServer.Authenticate", FakeAuthIn{Token: "secret"}, &FakeEmpty{}); err != nil {
+		t.Fatalf("authentication: %s", err)
+	}
+	if err := client.Call("RPCServer.State", FakeEmpty{}, &FakeState{}); err != nil {
+		t.Fatal(err)
+	}
+	// the proxy authenticates to the backend, which never sees the calls of
+	// the clients that failed
+	want := []string{"Authenticate secret", "SetApiVersion 1", "State"}
+	if calls := backend.received(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("backend received %v, want %v", calls, want)
+	}
+}
+
+func TestProxyReplaysAPIVersion(t *testing.T) {
+	a := newFakeBackend(t, "a")
+	defer a.close()
+	b := newFakeBackend(t, "b")
+	defer b.close()
+	p := newTestProxy(t, 1, "")
+	defer p.Close()
+	p.setBackend(a.addr())
+
+	client := dialProxy(t, p)
+	defer client.Close()
+	if err := client.Call("RPCServer.SetApiVersion", FakeVersionIn{APIVersion: 2}, &FakeEmpty{}); err != nil {
+		t.Fatal(err)
+	}
+	p.setBackend(b.addr())
+	var state FakeState
+	if err := client.Call("RPCServer.State", FakeEmpty{}, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Backend != "b" {
+		t.Errorf("state from backend %q, want b", state.Backend)
+	}
+	if calls := b.received(); !reflect.DeepEqual(calls, []string{"SetApiVersion 2", "State"}) {
+		t.Errorf("new backend received %v, want the API version of the client replayed", calls)
+	}
+}
+
+func TestProxySwapFailsCallsInFlight(t *testing.T) {
+	a := newFakeBackend(t, "a")
+	defer a.close()
+	b := newFakeBackend(t, "b")
+	defer b.close()
+	p := newTestProxy(t, 1, "")
+	defer p.Close()
+	p.setBackend(a.addr())
+
+	client := dialProxy(t, p)
+	defer client.Close()
+	call := client.Go("RPCServer.Stacktrace", FakeEmpty{}, &FakeState{}, nil)
+	<-a.entered
+	p.setBackend(b.addr())
+	if err := waitCall(t, call); err == nil || err.Error() != errBackendSwapped.Error() {
+		t.Errorf("call in flight during the swap: %v, want %v", err, errBackendSwapped)
+	}
+	close(a.release)
+
+	// the next calls go to the new backend
+	var state FakeState
+	if err := client.Call("RPCServer.State", FakeEmpty{}, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Backend != "b" {
+		t.Errorf("state from backend %q, want b", state.Backend)
+	}
+}
+
+func TestProxyCommandExitedOnSwap(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		a := newFakeBackend(t, "a")
+		p := newTestProxy(t, version, "")
+		p.setBackend(a.addr())
+
+		client := dialProxy(t, p)
+		var state struct {
+			Exited bool `json:"exited"`
+			State  struct {
+				Exited bool `json:"exited"`
+			}
+		}
+		call := client.Go("RPCServer.Command", FakeEmpty{}, &state, nil)
+		<-a.entered
+		// the module process exited
+		p.setBackend("")
+		if err := waitCall(t, call); err != nil {
+			t.Errorf("API v%d: Command in flight when the process is gone: %s", version, err)
+		}
+		exited := state.Exited
+		if version == 2 {
+			exited = state.State.Exited
+		}
+		if !exited {
+			t.Errorf("API v%d: Command in flight when the process is gone returned %+v, want an exited state", version, state)
+		}
+
+		close(a.release)
+		client.Close()
+		p.Close()
+		a.close()
+	}
+}
+
+func TestProxyBackendUnreachable(t *testing.T) {
+	backend := newFakeBackend(t, "a")
+	addr := backend.addr()
+	backend.close()
+	p := newTestProxy(t, 1, "")
+	defer p.Close()
+	p.setBackend(addr)
+
+	client := dialProxy(t, p)
+	defer client.Close()
+	err := client.Call("RPCServer.State", FakeEmpty{}, &FakeState{})
+	if err == nil || !strings.Contains(err.Error(), "couldn't reach the Delve server") {
+		t.Errorf("call with an unreachable backend: %v", err)
+	}
+}
+
+func TestLazyClientEventsInOrder(t *testing.T) {
+	p := newTestProxy(t, 1, "")
+	defer p.Close()
+	frontend := newTarget("frontend", "", 0)
+	frontend.lazy = true
+	p.lazy(frontend.clientEvent)
+
+	// the part of the run loop counting the clients
+	const clients = 50
+	negative := make(chan bool, 1)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2*clients; i++ {
+			if delta := <-frontend.clients; delta > 0 {
+				frontend.clientConnected()
+			} else {
+				frontend.clientDisconnected()
+			}
+			frontend.mu.Lock()
+			count := frontend.status.Clients
+			frontend.mu.Unlock()
+			if count < 0 {
+				select {
+				case negative <- true:
+				default:
+				}
+			}
+		}
+		close(done)
+	}()
+
+	for i := 0; i < clients; i++ {
+		conn, err := net.Dial("tcp", p.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client events missing")
+	}
+	select {
+	case <-negative:
+		t.Error("a disconnection was counted before its connection")
+	default:
+	}
+	if count := frontend.status.Clients; count != 0 {
+		t.Errorf("%d clients counted after all disconnected, want 0", count)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+
+	"github.com/derekparker/delve/service/api"
+	"github.com/derekparker/delve/service/debugger"
+)
+
+// resumeProcess continues the attached process so that the module keeps
+// serving requests until a breakpoint is hit. The process is continued again
+// after each tracepoint, whose hit is printed. It returns when the process
+// stops or exits.
+func resumeProcess(t *target, d *debugger.Debugger) {
+	pid := d.ProcessPid()
+	for {
+		state, err := d.Command(&api.DebuggerCommand{Name: api.Continue})
+		if err != nil {
+			log.Printf("Target %s: couldn't continue PID %d: %s\n", t, pid, err)
+			return
+		}
+		if state.Exited {
+			// reported by the exit watcher
+			return
+		}
+
+		threads := stoppedThreads(state)
+		if len(threads) == 0 {
+			log.Printf("Target %s: PID %d halted\n", t, pid)
+			return
+		}
+		stopped := false
+		for _, th := range threads {
+			if th.Breakpoint.Tracepoint {
+				printTracepointHit(t, th)
+				continue
+			}
+			log.Printf("Target %s: PID %d stopped at breakpoint %s\n", t, pid, describeBreakpoint(th.Breakpoint))
+			stopped = true
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// stoppedThreads returns the threads stopped at a breakpoint
+func stoppedThreads(state *api.DebuggerState) []*api.Thread {
+	threads := []*api.Thread{}
+	for _, th := range state.Threads {
+		if th.Breakpoint != nil {
+			threads = append(threads, th)
+		}
+	}
+	return threads
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxScanBackoff caps the delay between two scans after consecutive failures
+const maxScanBackoff = 2 * time.Minute
+
+// ScanError is a failure to list the processes, the scan is retried later
+type ScanError struct {
+	Err error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("listing the processes: %s", e.Err)
+}
+
+// ProcessReadError is a failure to read a process during a scan, the process is skipped
+type ProcessReadError struct {
+	Pid int
+	Err error
+}
+
+func (e *ProcessReadError) Error() string {
+	return fmt.Sprintf("reading PID %d: %s", e.Pid, e.Err)
+}
+
+// scanStatus is the state of the scanner as reported by the status API
+type scanStatus struct {
+	Scans               int       `json:"scans"`
+	Failures            int       `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	SkippedProcesses    int       `json:"skippedProcesses"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastErrorAt         time.Time `json:"lastErrorAt"`
+	RetryAt             time.Time `json:"retryAt"`
+}
+
+// scanner counts the scans and their failures, and spaces out the scans after
+// consecutive failures
+var scanner = struct {
+	sync.Mutex
+	status scanStatus
+}{}
+
+// scanSucceeded records a scan that listed the processes
+func scanSucceeded() {
+	scanner.Lock()
+	defer scanner.Unlock()
+	if scanner.status.ConsecutiveFailures > 0 {
+		log.Printf("Scan succeeded after %d failures\n", scanner.status.ConsecutiveFailures)
+	}
+	scanner.status.Scans++
+	scanner.status.ConsecutiveFailures = 0
+	scanner.status.RetryAt = time.Time{}
+}
+
+// scanFailed records a failed scan and delays the next one: by the scan delay,
+// doubled after each consecutive failure
+func scanFailed(err error) {
+	scanner.Lock()
+	defer scanner.Unlock()
+	scanner.status.Scans++
+	scanner.status.Failures++
+	scanner.status.ConsecutiveFailures++
+	scanner.status.LastError = err.Error()
+	scanner.status.LastErrorAt = time.Now()
+
+	backoff := time.Duration(delaySeconds) * time.Second
+	for i := 1; i < scanner.status.ConsecutiveFailures && backoff < maxScanBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxScanBackoff {
+		backoff = maxScanBackoff
+	}
+	scanner.status.RetryAt = time.Now().Add(backoff)
+	log.Printf("Scan failed (%d in a row, %d in total), retrying in %s: %s\n", scanner.status.ConsecutiveFailures, scanner.status.Failures, backoff, err)
+}
+
+// processSkipped records a process that couldn't be read during a scan
+func processSkipped(err *ProcessReadError) {
+	scanner.Lock()
+	scanner.status.SkippedProcesses++
+	scanner.status.LastError = err.Error()
+	scanner.status.LastErrorAt = time.Now()
+	scanner.Unlock()
+	log.Printf("Scan: skipping process: %s\n", err)
+}
+
+// scanReady returns false while the scans are backing off after a failure
+func scanReady() bool {
+	scanner.Lock()
+	defer scanner.Unlock()
+	return time.Now().After(scanner.status.RetryAt)
+}
+
+// scannerStatus returns a copy of the state of the scanner
+func scannerStatus() scanStatus {
+	scanner.Lock()
+	defer scanner.Unlock()
+	return scanner.status
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// handleSignals shuts down on SIGINT or SIGTERM: the watcher is stopped and
+// each target detaches from its module process without killing it. A second
+// signal forces the exit.
+func handleSignals(targets []*target, stopWatching chan<- bool) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Printf("Received %s, detaching from the module processes (send it again to force the exit)\n", sig)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s again, exiting without detaching\n", sig)
+		os.Exit(1)
+	}()
+
+	close(stopWatching)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			t.do(actionShutdown, ProcessIdentity{})
+		}(t)
+	}
+	wg.Wait()
+	// the processes stopped at exec and not attached yet
+	releaseAllHeld()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processStatus is a module process found by the scanner
+type processStatus struct {
+	PID       int    `json:"pid"`
+	PPID      int    `json:"ppid"`
+	StartTime uint64 `json:"startTime"`
+	ExeInode  uint64 `json:"exeInode,omitempty"`
+	Zombie    bool   `json:"zombie"`
+	Module    string `json:"module,omitempty"`
+	// Instance is the index of the process among the instances of its module
+	Instance *int `json:"instance,omitempty"`
+	// Source is the directory of the module yaml file given to dev_appserver
+	Source string `json:"source,omitempty"`
+	// Matches is true if the process is identified by the module selector and key of the target
+	Matches bool `json:"matches"`
+
+	info ModuleInfo
+}
+
+func newProcessStatus(p Process, info ModuleInfo, matches bool) processStatus {
+	id := p.Identity()
+	status := processStatus{
+		PID:       id.Pid,
+		PPID:      p.PPid(),
+		StartTime: id.StartTime,
+		ExeInode:  id.Inode,
+		Zombie:    p.Zombie(),
+		Matches:   matches,
+		info:      info,
+	}
+	if info.Known() {
+		status.Module = info.String()
+	}
+	if info.Instance >= 0 {
+		instance := info.Instance
+		status.Instance = &instance
+	}
+	status.Source = info.Source
+	return status
+}
+
+// identity returns the identity of the process found by the scanner
+func (s processStatus) identity() ProcessIdentity {
+	return ProcessIdentity{Pid: s.PID, StartTime: s.StartTime, Inode: s.ExeInode}
+}
+
+// States of a target
+const (
+	stateWaiting       = "waiting for module"
+	stateWaitingClient = "waiting for client"
+	stateAttached      = "attached"
+	stateDetached      = "detached"
+)
+
+// exitStatus is the last exit of an attached process
+type exitStatus struct {
+	PID int `json:"pid"`
+	// Status is the exit status, unknown when it couldn't be collected
+	Status *int      `json:"status,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// targetStatus is the state of a target as reported by the status API
+type targetStatus struct {
+	Key           string          `json:"key,omitempty"`
+	Module        string          `json:"module,omitempty"`
+	Port          int             `json:"port"`
+	Policy        string          `json:"instances"`
+	Listen        string          `json:"listen"`
+	State         string          `json:"state"`
+	AttachedPID   int             `json:"attachedPid"`
+	AttachedAt    time.Time       `json:"attachedAt"`
+	ReattachCount int             `json:"reattachCount"`
+	PinnedPID     int             `json:"pinnedPid,omitempty"`
+	Detached      bool            `json:"detached"`
+	Wrapped       bool            `json:"wrapped"`
+	Clients       int             `json:"clients"`
+	LastExit      *exitStatus     `json:"lastExit,omitempty"`
+	Processes     []processStatus `json:"processes"`
+}
+
+// statusServer serves the status and control API of the watcher
+type statusServer struct {
+	targets []*target
+	// token is required by the actions when it is set
+	token string
+}
+
+// serveStatus starts the status and control HTTP API on the address
+func serveStatus(addr string, targets []*target) error {
+	s := &statusServer{targets: targets, token: authToken}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/reattach", s.handleAction(actionReattach))
+	mux.HandleFunc("/detach", s.handleAction(actionDetach))
+	mux.HandleFunc("/pin", s.handleAction(actionPin))
+	mux.HandleFunc("/unpin", s.handleAction(actionUnpin))
+	mux.HandleFunc("/wrap", s.handleWrap)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Status API listening on http://%s/status\n", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Status API stopped: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// handleStatus lists the targets with their processes
+func (s *statusServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	statuses := []targetStatus{}
+	for _, t := range withInstances(s.targets) {
+		statuses = append(statuses, t.Status())
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"targets": statuses, "scanner": scannerStatus()})
+}
+
+// handleAction runs an action on the target given by the "target" parameter
+// (the key, key#index for an instance of the all policy, or the port), it can
+// be omitted when there is a single target.
+func (s *statusServer) handleAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed, use POST", r.Method))
+			return
+		}
+		if !s.authorized(w, r) {
+			return
+		}
+		t, err := s.findTarget(r.FormValue("target"))
+		if err != nil {
+			httpError(w, http.StatusNotFound, err)
+			return
+		}
+
+		process := ProcessIdentity{}
+		if action == actionPin {
+			pid, err := strconv.Atoi(r.FormValue("pid"))
+			if err != nil || pid <= 0 {
+				httpError(w, http.StatusBadRequest, fmt.Errorf("invalid pid %q", r.FormValue("pid")))
+				return
+			}
+			p, ok := t.findProcessStatus(pid)
+			if !ok {
+				httpError(w, http.StatusBadRequest, fmt.Errorf("PID %d is not a process of target %s", pid, t))
+				return
+			}
+			if p.Zombie {
+				httpError(w, http.StatusBadRequest, fmt.Errorf("PID %d is a zombie process", pid))
+				return
+			}
+			process = p.identity()
+		}
+
+		if err := t.do(action, process); err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, t.Status())
+	}
+}
+
+// authorized checks the token of an action, sent as "Authorization: Bearer
+// <token>", when the authentication is enabled. It answers 401 otherwise.
+func (s *statusServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.token) == 0 {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	httpError(w, http.StatusUnauthorized, errors.New("the token is required: Authorization: Bearer <token>"))
+	return false
+}
+
+func (s *statusServer) findTarget(name string) (*target, error) {
+	if len(name) == 0 {
+		if len(s.targets) == 1 {
+			return s.targets[0], nil
+		}
+		return nil, fmt.Errorf("several targets, use the target parameter")
+	}
+	for _, t := range withInstances(s.targets) {
+		if status := t.Status(); status.Key == name || strconv.Itoa(status.Port) == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("no target %q", name)
+}
+
+// describe returns the process with its module labels, for the logs
+func (t *target) describe(id ProcessIdentity) string {
+	if p, ok := t.findProcessStatus(id.Pid); ok && p.identity().Same(id) && p.info.Known() {
+		return id.String() + ", module " + p.info.Label()
+	}
+	return id.String()
+}
+
+// findProcessStatus returns the process found by the last scan among the processes of the target
+func (t *target) findProcessStatus(pid int) (processStatus, bool) {
+	for _, p := range t.Status().Processes {
+		if p.PID == pid && p.Matches {
+			return p, true
+		}
+	}
+	return processStatus{}, false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Status API: %s\n", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
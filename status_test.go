@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusActionsAuthorization(t *testing.T) {
+	// without target the authorized actions fail to find one
+	s := &statusServer{token: "secret"}
+	tests := []struct {
+		header string
+		code   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusNotFound},
+	}
+	for _, action := range []string{actionReattach, actionDetach, actionPin, actionUnpin} {
+		for _, test := range tests {
+			r, _ := http.NewRequest("POST", "/"+action, nil)
+			if len(test.header) > 0 {
+				r.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			s.handleAction(action)(w, r)
+			if w.Code != test.code {
+				t.Errorf("%s with Authorization %q: status %d, want %d", action, test.header, w.Code, test.code)
+			}
+		}
+	}
+
+	// no token, no authentication
+	s = &statusServer{}
+	r, _ := http.NewRequest("POST", "/detach", nil)
+	w := httptest.NewRecorder()
+	s.handleAction(actionDetach)(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("detach without token: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
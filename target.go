@@ -0,0 +1,684 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derekparker/delve/service"
+	"github.com/derekparker/delve/service/api"
+	"github.com/derekparker/delve/service/rpccommon"
+)
+
+// target is a module to debug. The module process is identified by the module
+// selector and the key, it is served by its own Delve server on the target port.
+type target struct {
+	key    string
+	module string
+	port   int
+	// matcher selects the module processes
+	matcher ProcessMatcher
+	// host the Delve server listens on, all interfaces when empty
+	host string
+	// socket is the path of the Unix socket the Delve server listens on instead of the port
+	socket string
+	// apiVersion is the Delve API version served by default
+	apiVersion int
+	// autoContinue resumes the process right after attach
+	autoContinue bool
+	// initFile is a file of breakpoint commands run on each attached process
+	initFile string
+	// traceFilter is a regexp on the functions traced on each attached process
+	traceFilter string
+	// traceDepth is the depth of the stack printed on each tracepoint hit
+	traceDepth int
+	// lazy attaches the process only when a client connects
+	lazy bool
+	// idleTimeout detaches in lazy mode when no client is connected for that long
+	idleTimeout time.Duration
+	// early stops the module processes at exec, to debug their initialization
+	early bool
+	// policy chooses the instance to debug when the module runs several processes
+	policy instancePolicy
+	// parent is the target of the first instance, for the other instances of the all policy
+	parent *target
+
+	// pidChan used to push the process to which we need to attach the debugger
+	pidChan chan ProcessIdentity
+	// control used to push the requests of the status API
+	control chan controlRequest
+	// exits used to push the exit of the attached process
+	exits chan processExit
+	// clientConns used to push the client connections accepted in lazy mode without proxy
+	clientConns chan net.Conn
+	// clients used to push the connections (1) and disconnections (-1) of the clients
+	clients chan int
+	// proxy owns the port of the target when the Delve servers are proxied
+	proxy *rpcProxy
+
+	// the current Delve server, owned by the run loop
+	stopChan    chan bool
+	server      *rpccommon.ServerImpl
+	breakpoints []*api.Breakpoint
+	// exitDone stops the exit watcher of the current process
+	exitDone chan bool
+	// public owns the port in lazy mode without proxy, the connections are
+	// handed to the Delve server through connListener
+	public       net.Listener
+	connListener *connListener
+	// idle fires when no client used the process for the idle timeout
+	idle <-chan time.Time
+	// attachedExe is the executable of the attached process, for the hooks
+	attachedExe string
+	// wrapped is true when the attached process was launched by the wrapper,
+	// whose Delve server is the backend of the proxy
+	wrapped bool
+	// hooks queues the attach and detach events to the hook runner, hooksDone
+	// is closed once it ran them all
+	hooks     chan hookEvent
+	hooksDone chan bool
+
+	mu       sync.Mutex
+	status   targetStatus
+	attached ProcessIdentity
+	pinned   ProcessIdentity
+	// pending is the process attached when the next client connects in lazy mode
+	pending ProcessIdentity
+	// instances are the targets of the other instances, with the all policy
+	instances []*target
+	// slots are the processes of the instances, with the index and all policies
+	slots instanceSlots
+	// autoPort is true when the port was selected by the system
+	autoPort bool
+}
+
+// controlRequest is an action asked through the status API
+type controlRequest struct {
+	action  string
+	process ProcessIdentity
+	// addr is the Delve server of the wrapper, for the wrap action
+	addr string
+	done chan error
+}
+
+// Actions of the status API
+const (
+	actionReattach = "reattach"
+	actionDetach   = "detach"
+	actionPin      = "pin"
+	actionUnpin    = "unpin"
+	actionWrap     = "wrap"
+	actionShutdown = "shutdown"
+)
+
+func newTarget(key string, module string, port int) *target {
+	t := &target{
+		key:     key,
+		module:  module,
+		port:    port,
+		host:    defaultHost,
+		matcher: NameMatcher{Name: "_go_app"},
+		policy:  instancePolicy{kind: defaultInstancePolicy},
+		pidChan: make(chan ProcessIdentity),
+		control: make(chan controlRequest),
+		exits:   make(chan processExit),
+
+		clientConns: make(chan net.Conn),
+		clients:     make(chan int),
+	}
+	t.status = targetStatus{Key: key, Module: module, Port: port, Processes: []processStatus{}}
+	return t
+}
+
+// parseTargets builds the targets from the -targets flag value. Without
+// value a single target is built with the given key, module and port.
+func parseTargets(value string, key string, module string, port int) ([]*target, error) {
+	if len(strings.TrimSpace(value)) == 0 {
+		return []*target{newTarget(key, module, port)}, nil
+	}
+	if len(module) > 0 {
+		return nil, errors.New("-module can't be used with -targets, the target keys are matched against the module names")
+	}
+
+	type item struct {
+		key  string
+		port int
+	}
+	items := []item{}
+	ports := map[int]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		k, p := entry, 0
+		if i := strings.Index(entry, "="); i >= 0 {
+			k = strings.TrimSpace(entry[:i])
+			var err error
+			if p, err = strconv.Atoi(strings.TrimSpace(entry[i+1:])); err != nil || p <= 0 || p > 65535 {
+				return nil, fmt.Errorf("invalid port for target %q: %s", k, entry[i+1:])
+			}
+			// the explicit ports are reserved before assigning the other ones
+			if ports[p] {
+				return nil, fmt.Errorf("port %d is used by several targets", p)
+			}
+			ports[p] = true
+		}
+		items = append(items, item{key: k, port: p})
+	}
+
+	targets := []*target{}
+	keys := map[string]bool{}
+	nextPort := port
+	for _, it := range items {
+		k, p := it.key, it.port
+		if len(k) == 0 {
+			return nil, errors.New("a target must have a module key")
+		}
+		if keys[k] {
+			return nil, fmt.Errorf("target %q is defined twice", k)
+		}
+		if p == 0 && nextPort > 0 {
+			for ports[nextPort] {
+				nextPort++
+			}
+			p = nextPort
+			if p > 65535 {
+				return nil, fmt.Errorf("no port left for target %q after %d", k, port)
+			}
+			// port 0 is selected by the system for each target
+			ports[p] = true
+		}
+		keys[k] = true
+		targets = append(targets, newTarget(k, "", p))
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no target defined")
+	}
+	return targets, nil
+}
+
+// isModuleProcess returns true if the process is selected by the matcher of the target
+func (t *target) isModuleProcess(p Process) bool {
+	return t.matcher.Match(p)
+}
+
+// matches returns true if the process runs the module of the target
+func (t *target) matches(p Process, info ModuleInfo) bool {
+	if !t.isModuleProcess(p) {
+		return false
+	}
+	if len(t.module) > 0 && !info.Matches(t.module) {
+		return false
+	}
+	return matchesKey(p, info, t.key)
+}
+
+// addr is the address of the Delve server of the target
+func (t *target) addr() string {
+	if len(t.socket) > 0 {
+		return t.socket
+	}
+	return net.JoinHostPort(t.host, strconv.Itoa(t.port))
+}
+
+func (t *target) String() string {
+	where := fmt.Sprintf(":%d", t.port)
+	if len(t.socket) > 0 {
+		where = ":" + unixPrefix + t.socket
+	}
+	if t.parent != nil {
+		return fmt.Sprintf("%s#%d%s", t.key, t.policy.index, where)
+	}
+	return t.key + where
+}
+
+// run waits for a PID and attach a new debugger to it
+func (t *target) run() {
+	t.hooks, t.hooksDone = make(chan hookEvent, 32), make(chan bool)
+	go t.runHooks(t.hooks, t.hooksDone)
+	if useProxy {
+		listener, err := listen(t.network(), t.addr())
+		if err != nil {
+			log.Fatalf("Target %s: couldn't listen on %s: %s\n", t, t.addr(), err)
+		}
+		t.resolvePort(listener)
+		t.proxy = newRPCProxy(publicListener(listener), t.apiVersion, authToken)
+		if t.lazy {
+			t.proxy.lazy(t.clientEvent)
+		}
+	} else if t.lazy {
+		listener, err := listen(t.network(), t.addr())
+		if err != nil {
+			log.Fatalf("Target %s: couldn't listen on %s: %s\n", t, t.addr(), err)
+		}
+		t.resolvePort(listener)
+		t.public = publicListener(listener)
+		go t.acceptClients(t.public)
+	} else if err := t.selectPort(); err != nil {
+		log.Fatalf("Target %s: couldn't listen on %s: %s\n", t, t.addr(), err)
+	}
+	t.publish()
+
+	for {
+		select {
+		case id := <-t.pidChan:
+			if !id.IsZero() && !id.Same(t.debuggedProcess()) {
+				if err := t.switchTo(id, reasonProcess); err != nil {
+					log.Printf("Target %s: %s\n", t, err)
+				}
+			}
+		case req := <-t.control:
+			if req.action == actionShutdown {
+				t.shutdown()
+				req.done <- nil
+				return
+			}
+			req.done <- t.handle(req)
+		case exit := <-t.exits:
+			if exit.process.Same(t.attachedProcess()) {
+				t.release(exit)
+			}
+		case conn := <-t.clientConns:
+			t.clientConnected()
+			if t.connListener == nil || t.connListener.push(conn) != nil {
+				log.Printf("Target %s: no module process to debug, closing the client connection\n", t)
+				conn.Close()
+			}
+		case delta := <-t.clients:
+			if delta > 0 {
+				t.clientConnected()
+			} else {
+				t.clientDisconnected()
+			}
+		case <-t.idle:
+			t.idleDetach()
+		}
+	}
+}
+
+// handle runs an action of the status API
+func (t *target) handle(req controlRequest) error {
+	switch req.action {
+	case actionReattach:
+		t.mu.Lock()
+		id := t.attached
+		t.status.Detached = false
+		t.mu.Unlock()
+		if t.wrapped {
+			return fmt.Errorf("%s was launched by the wrapper, it can't be reattached", id)
+		}
+		if !id.IsZero() {
+			t.detach(reasonReattach)
+			return t.attach(id, reasonReattach)
+		}
+	case actionDetach:
+		t.detach(reasonDetach)
+		t.mu.Lock()
+		t.status.Detached = true
+		t.mu.Unlock()
+	case actionPin:
+		t.mu.Lock()
+		t.pinned = req.process
+		t.status.PinnedPID = req.process.Pid
+		t.status.Detached = false
+		id := t.attached
+		t.mu.Unlock()
+		if !id.Same(req.process) {
+			return t.switchTo(req.process, reasonPin)
+		}
+	case actionUnpin:
+		t.mu.Lock()
+		t.pinned = ProcessIdentity{}
+		t.status.PinnedPID = 0
+		t.mu.Unlock()
+	case actionWrap:
+		return t.wrap(req.process, req.addr)
+	default:
+		return fmt.Errorf("unknown action %q", req.action)
+	}
+	return nil
+}
+
+// switchTo debugs the process instead of the current one. In lazy mode it is
+// attached right away only if a client is connected, otherwise when the next
+// client connects.
+func (t *target) switchTo(id ProcessIdentity, reason string) error {
+	t.detach(reason)
+	t.mu.Lock()
+	wait := t.lazy && t.status.Clients == 0
+	if wait {
+		t.pending = id
+	}
+	t.mu.Unlock()
+	if wait {
+		log.Printf("Target %s: found %s, attaching when a client connects\n", t, t.describe(id))
+		t.publish()
+		return nil
+	}
+	return t.attach(id, reason)
+}
+
+// attach starts a Delve server attached to the process. It fails if the
+// process is gone, even if its PID was given to a new process. The reason is
+// passed to the on-attach hook.
+func (t *target) attach(id ProcessIdentity, reason string) error {
+	t.mu.Lock()
+	t.pending = ProcessIdentity{}
+	t.mu.Unlock()
+	if current, err := currentIdentity(id.Pid); err != nil || !current.Same(id) {
+		return fmt.Errorf("%s is gone, not attaching", id)
+	}
+	if tracer := tracerPid(id.Pid); tracer != 0 {
+		return fmt.Errorf("%s is traced by PID %d, not attaching (launched by the wrapper?)", id, tracer)
+	}
+	log.Printf("Target %s: attaching to %s\n", t, t.describe(id))
+
+	// behind the proxy the Delve server listens on a private socket
+	var listener net.Listener
+	var err error
+	switch {
+	case t.proxy != nil:
+		if listener, err = listenBackend(); err != nil {
+			return fmt.Errorf("couldn't listen for the Delve server of %s: %s", id, err)
+		}
+	case t.public != nil:
+		t.connListener = newConnListener(t.public.Addr())
+		listener = t.connListener
+	default:
+		if listener, err = listen(t.network(), t.addr()); err != nil {
+			return fmt.Errorf("couldn't listen for the Delve server of %s: %s", id, err)
+		}
+		listener = publicListener(listener)
+	}
+	// a process stopped at exec is run to its initialization by the debugger
+	held := t.early && claimHeld(id)
+	stopChan, server, err := t.attachDelveServer(listener, id.Pid, t.breakpoints, held)
+	if err != nil {
+		// not recorded as attached, so that the process is attached again by the next scan
+		if held {
+			resumeHeld(id, "attach failed")
+		}
+		if t.connListener != nil {
+			// no server to hand the clients to
+			t.connListener.Close()
+			t.connListener = nil
+		}
+		return fmt.Errorf("couldn't attach to %s: %s", id, err)
+	}
+	t.stopChan, t.server = stopChan, server
+	d := server.Debugger()
+	if t.proxy != nil {
+		t.proxy.setBackend(backendAddr(listener))
+	}
+	t.exitDone = make(chan bool)
+	go watchExit(id, d, t.exits, t.exitDone)
+	t.attachedExe, _ = processExePath(id.Pid)
+	t.fireHook(hookEvent{event: eventAttach, reason: reason, process: id, exe: t.attachedExe})
+
+	t.setAttached(id)
+	return nil
+}
+
+// setAttached records the attached process in the status and publishes it
+func (t *target) setAttached(id ProcessIdentity) {
+	t.mu.Lock()
+	if !t.status.AttachedAt.IsZero() {
+		t.status.ReattachCount++
+	}
+	t.attached = id
+	t.status.AttachedPID = id.Pid
+	t.status.AttachedAt = time.Now()
+	t.mu.Unlock()
+	t.publish()
+}
+
+// detach stops the current Delve server, if any, keeping its breakpoints for
+// the next process. The reason is passed to the on-detach hook.
+func (t *target) detach(reason string) {
+	t.mu.Lock()
+	t.pending = ProcessIdentity{}
+	t.mu.Unlock()
+	t.idle = nil
+	if t.stopChan == nil && !t.wrapped {
+		return
+	}
+	if t.exitDone != nil {
+		close(t.exitDone)
+		t.exitDone = nil
+	}
+	if t.server != nil {
+		if bps, ok := snapshotBreakpoints(t.server.Debugger()); ok {
+			t.breakpoints = bps
+		}
+	}
+	if t.proxy != nil {
+		t.proxy.setBackend("")
+	}
+	if t.stopChan != nil {
+		t.stopChan <- true
+		if t.proxy == nil && t.public == nil {
+			t.waitForFreePort()
+		}
+	}
+	t.stopChan, t.server, t.connListener, t.wrapped = nil, nil, nil, false
+
+	t.mu.Lock()
+	id := t.attached
+	t.attached = ProcessIdentity{}
+	t.status.AttachedPID = 0
+	t.status.Wrapped = false
+	t.mu.Unlock()
+	if !id.IsZero() {
+		t.fireHook(hookEvent{event: eventDetach, reason: reason, process: id, exe: t.attachedExe})
+	}
+	t.attachedExe = ""
+	t.publish()
+}
+
+// shutdown removes the breakpoints from the attached process, detaches from it
+// without killing it and closes the listeners of the target
+func (t *target) shutdown() {
+	id := t.attachedProcess()
+	removed := 0
+	if t.server != nil {
+		removed = clearBreakpoints(t.server.Debugger())
+	}
+	t.breakpoints = nil
+
+	stopped := t.stopChan
+	t.detach(reasonShutdown)
+	if stopped != nil {
+		// wait for the Delve server to detach
+		<-stopped
+	}
+	// let the hooks of the last events run
+	close(t.hooks)
+	<-t.hooksDone
+	for _, instance := range t.instanceTargets() {
+		instance.do(actionShutdown, ProcessIdentity{})
+	}
+	if t.proxy != nil {
+		t.proxy.Close()
+	}
+	if t.public != nil {
+		t.public.Close()
+	}
+
+	attaches := 0
+	if status := t.Status(); !status.AttachedAt.IsZero() {
+		attaches = status.ReattachCount + 1
+	}
+	if id.IsZero() {
+		log.Printf("Target %s: stopped, no module process attached (%d attaches in total)\n", t, attaches)
+	} else {
+		log.Printf("Target %s: detached from PID %d, %d breakpoints removed (%d attaches in total)\n", t, id.Pid, removed, attaches)
+	}
+}
+
+// release stops the Delve server of the exited process, freeing the port, and
+// waits for the next module process
+func (t *target) release(exit processExit) {
+	if exit.status != nil {
+		log.Printf("Target %s: PID %d exited with status %d, waiting for the module\n", t, exit.process.Pid, *exit.status)
+	} else {
+		log.Printf("Target %s: PID %d is gone, waiting for the module\n", t, exit.process.Pid)
+	}
+	t.detach(reasonExit)
+
+	t.mu.Lock()
+	t.status.LastExit = &exitStatus{PID: exit.process.Pid, Status: exit.status, At: time.Now()}
+	t.mu.Unlock()
+}
+
+// attachedProcess returns the process currently attached to the debugger
+func (t *target) attachedProcess() ProcessIdentity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.attached
+}
+
+// debuggedProcess returns the attached process or, in lazy mode, the process
+// attached when the next client connects
+func (t *target) debuggedProcess() ProcessIdentity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.attached.IsZero() {
+		return t.pending
+	}
+	return t.attached
+}
+
+// choose returns the process to debug among the target processes: the pinned
+// one if any, the one of the instance policy otherwise. It returns no process
+// when detached.
+func (t *target) choose(processes []Process) ProcessIdentity {
+	t.mu.Lock()
+	detached, pinned := t.status.Detached, t.pinned
+	t.mu.Unlock()
+	if detached {
+		return ProcessIdentity{}
+	}
+	if !pinned.IsZero() {
+		for _, p := range processes {
+			if id := p.Identity(); id.Same(pinned) && !p.Zombie() {
+				return id
+			}
+		}
+		log.Printf("Target %s: pinned %s is gone, back to the %s instance policy\n", t, pinned, t.policy)
+		t.mu.Lock()
+		t.pinned = ProcessIdentity{}
+		t.status.PinnedPID = 0
+		t.mu.Unlock()
+	}
+	return t.policy.pick(processes, t.instanceSlots())
+}
+
+// setDiscovered records the module processes found by the last scan
+func (t *target) setDiscovered(processes []processStatus) {
+	if processes == nil {
+		processes = []processStatus{}
+	}
+	t.mu.Lock()
+	t.status.Processes = processes
+	t.mu.Unlock()
+}
+
+// Status returns a copy of the status of the target
+func (t *target) Status() targetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.status
+	status.Port = t.port
+	status.Policy = t.policy.String()
+	status.Listen = unixPrefix + t.socket
+	if t.network() == "tcp" {
+		status.Listen = t.addr()
+	}
+	switch {
+	case status.Detached:
+		status.State = stateDetached
+	case !t.attached.IsZero():
+		status.State = stateAttached
+	case !t.pending.IsZero():
+		status.State = stateWaitingClient
+	default:
+		status.State = stateWaiting
+	}
+	return status
+}
+
+// do asks the run loop to execute an action and waits for its result
+func (t *target) do(action string, process ProcessIdentity) error {
+	req := controlRequest{action: action, process: process, done: make(chan error)}
+	t.control <- req
+	return <-req.done
+}
+
+func (t *target) waitForFreePort() {
+	var errCon error
+	var conn net.Conn
+	for errCon == nil {
+		conn, errCon = net.Dial(t.network(), t.addr())
+		if errCon == nil {
+			log.Println("Old server still listening.")
+			conn.Close()
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+
+func (t *target) attachDelveServer(listener net.Listener, attachPid int, breakpoints []*api.Breakpoint, held bool) (chan bool, *rpccommon.ServerImpl, error) {
+	stopChan := make(chan bool)
+	var server *rpccommon.ServerImpl
+	var runErr error
+	var wgServerRunning sync.WaitGroup
+	wgServerRunning.Add(1)
+	go func() {
+		defer close(stopChan)
+		defer listener.Close()
+
+		// Create and start a debugger server
+		server = rpccommon.NewServer(&service.Config{
+			Listener:    listener,
+			ProcessArgs: []string{},
+			AttachPid:   attachPid,
+			AcceptMulti: true,
+			APIVersion:  t.apiVersion,
+			AuthToken:   authToken,
+		}, true)
+		if runErr = server.Run(); runErr != nil {
+			wgServerRunning.Done()
+			return
+		}
+		defer server.Stop(false)
+		if len(t.initFile) > 0 {
+			if err := runInitFile(server.Debugger(), t.initFile); err != nil {
+				log.Printf("Couldn't run init file %s: %s\n", t.initFile, err)
+			}
+		}
+		restoreBreakpoints(server.Debugger(), breakpoints)
+		if len(t.traceFilter) > 0 {
+			if err := setTracepoints(server.Debugger(), t.traceFilter, t.traceDepth); err != nil {
+				log.Printf("Couldn't set tracepoints: %s\n", err)
+			}
+		}
+		switch {
+		case held:
+			go stopAtInit(t, server.Debugger())
+		case t.autoContinue:
+			go resumeProcess(t, server.Debugger())
+		}
+		wgServerRunning.Done()
+		<-stopChan
+	}()
+
+	//wait for the server to be running
+	wgServerRunning.Wait()
+	return stopChan, server, runErr
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	tests := []struct {
+		value string
+		ports map[string]int
+	}{
+		{"", map[string]int{"": 2345}},
+		{"frontend,worker", map[string]int{"frontend": 2345, "worker": 2346}},
+		{"frontend=3000,worker", map[string]int{"frontend": 3000, "worker": 2345}},
+		// the explicit ports are reserved before the others are assigned
+		{"frontend,worker,admin=2346", map[string]int{"frontend": 2345, "worker": 2347, "admin": 2346}},
+		{"a,b=2345", map[string]int{"a": 2346, "b": 2345}},
+	}
+	for _, test := range tests {
+		targets, err := parseTargets(test.value, "", "", 2345)
+		if err != nil {
+			t.Errorf("parseTargets(%q): %s", test.value, err)
+			continue
+		}
+		ports := map[string]int{}
+		for _, target := range targets {
+			ports[target.key] = target.port
+		}
+		if !reflect.DeepEqual(ports, test.ports) {
+			t.Errorf("parseTargets(%q) ports = %v, want %v", test.value, ports, test.ports)
+		}
+	}
+}
+
+func TestParseTargetsAutoSelectedPorts(t *testing.T) {
+	targets, err := parseTargets("frontend,worker", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		if target.port != 0 {
+			t.Errorf("target %s: port %d, want 0 to be selected by the system", target.key, target.port)
+		}
+	}
+}
+
+func TestParseTargetsErrors(t *testing.T) {
+	for _, value := range []string{
+		"a=2345,b=2345",
+		"a,a",
+		"=2345",
+		"a=x",
+		"a=-1",
+		"a=65536",
+		"a=70000",
+		",",
+	} {
+		if _, err := parseTargets(value, "", "", 2345); err == nil {
+			t.Errorf("parseTargets(%q) succeeded, want an error", value)
+		}
+	}
+	if _, err := parseTargets("a,b,c=65535", "", "", 65534); err == nil {
+		t.Error("parseTargets beyond port 65535 succeeded, want an error")
+	}
+	if _, err := parseTargets("a,b", "", "frontend", 2345); err == nil {
+		t.Error("parseTargets with a module succeeded, want an error")
+	}
+}
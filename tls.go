@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// serverTLSConfig builds the TLS configuration of the listeners, the hosts go
+// in the self-signed certificate
+func serverTLSConfig(settings TLSConfig, hosts []string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case len(settings.Cert) > 0 && len(settings.Key) > 0:
+		cert, err = tls.LoadX509KeyPair(settings.Cert, settings.Key)
+	case len(settings.Cert) > 0 || len(settings.Key) > 0:
+		err = errors.New("the certificate and the key go together")
+	default:
+		cert, err = selfSignedCertificate(hosts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("TLS certificate SHA-256 fingerprint: %s\n", fingerprint(cert.Certificate[0]))
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(settings.ClientCA) > 0 {
+		pem, err := ioutil.ReadFile(settings.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", settings.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// selfSignedCertificate generates a certificate for the hosts, valid for a year
+func selfSignedCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"delveAppengine"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	for _, h := range append(hosts, "localhost", "127.0.0.1", "::1") {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if len(h) > 0 {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Println("Generated a self-signed TLS certificate")
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// fingerprint formats the SHA-256 of the certificate as AB:CD:...
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// publicListener wraps the listener of the port of a target with TLS, when enabled
+func publicListener(listener net.Listener) net.Listener {
+	if tlsConfig == nil {
+		return listener
+	}
+	return tls.NewListener(listener, tlsConfig)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/derekparker/delve/service/api"
+	"github.com/derekparker/delve/service/debugger"
+)
+
+// setTracepoints places a tracepoint on every function of the process matching
+// the filter regexp. The hits report the goroutine, the arguments and the stack
+// up to depth frames.
+func setTracepoints(d *debugger.Debugger, filter string, depth int) error {
+	funcs, err := d.Functions(filter)
+	if err != nil {
+		return err
+	}
+
+	set := 0
+	for _, fn := range funcs {
+		_, err := d.CreateBreakpoint(&api.Breakpoint{
+			FunctionName: fn,
+			Line:         -1,
+			Tracepoint:   true,
+			Goroutine:    true,
+			Stacktrace:   depth,
+			LoadArgs:     &shortLoadConfig,
+		})
+		if err != nil && !isAlreadySet(err) {
+			log.Printf("Trace: couldn't set tracepoint on %s: %s\n", fn, err)
+			continue
+		}
+		set++
+	}
+	log.Printf("Trace: %d function(s) matching %q traced\n", set, filter)
+	return nil
+}
+
+// printTracepointHit prints the goroutine, function, arguments and stack of a tracepoint hit
+func printTracepointHit(t *target, th *api.Thread) {
+	var buf bytes.Buffer
+	fn := "?"
+	if th.Function != nil {
+		fn = th.Function.Name
+	}
+	fmt.Fprintf(&buf, "> goroutine(%d): %s(", th.GoroutineID, fn)
+
+	info := th.BreakpointInfo
+	if info != nil {
+		for i, arg := range info.Arguments {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%s=%s", arg.Name, arg.SinglelineString())
+		}
+	}
+	buf.WriteString(")")
+
+	if info != nil {
+		for _, v := range info.Variables {
+			fmt.Fprintf(&buf, "\n\t%s: %s", v.Name, v.SinglelineString())
+		}
+		for i, frame := range info.Stacktrace {
+			name := "?"
+			if frame.Function != nil {
+				name = frame.Function.Name
+			}
+			fmt.Fprintf(&buf, "\n\t%d  %#016x in %s\n\t    at %s:%d", i, frame.PC, name, frame.File, frame.Line)
+		}
+	}
+	log.Printf("Target %s: %s\n", t, buf.String())
+}
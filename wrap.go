@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/derekparker/delve/service"
+	"github.com/derekparker/delve/service/rpccommon"
+)
+
+// statusAddrEnv is the environment variable giving the status API of the watcher to the wrapper
+const statusAddrEnv = "DELVEAPPENGINE_STATUS_ADDR"
+
+// wrapperEnv is set by the wrapper in the environment of the module process,
+// to its own PID: the module is identified from the dev_appserver above it
+const wrapperEnv = "DELVEAPPENGINE_WRAPPER_PID"
+
+// registerTimeout is how long the wrapper waits for the watcher to take the module process
+const registerTimeout = 5 * time.Second
+
+// wrapExitTimeout is how long the wrapper waits for the killed module process to exit
+const wrapExitTimeout = 3 * time.Second
+
+// runWrap runs the wrap subcommand, that dev_appserver runs in place of the
+// module binary. The binary is launched under a Delve server and stopped
+// before its first instruction, and registered with the watcher: its target
+// proxies the clients to the Delve server of the wrapper. Without watcher the
+// wrapper serves the module on its own port. It returns the exit status of the module.
+func runWrap(args []string) int {
+	flags := flag.NewFlagSet("wrap", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: delveAppengine wrap [flags] [--] <module binary> [arguments]")
+		flags.PrintDefaults()
+	}
+	watcher := flags.String("status-addr", os.Getenv(statusAddrEnv), "Status API of the running delveAppengine to register the module process with (default $"+statusAddrEnv+")")
+	targetName := flags.String("target", "", "Target of the watcher debugging the module: key, key#index or port (default the target matching the module process)")
+	port := flags.Int("port", 2345, "Port of the Delve server when no watcher takes the module process, 0 to select a free port")
+	listenFlag := flags.String("listen", "", "Address of the Delve server when no watcher takes the module process: host, host:port or unix:/path/to/socket (default 127.0.0.1 on -port)")
+	initFile := flags.String("init", "", "File of Delve commands (break, trace, cond, on) run before the module starts, it is then continued if they set breakpoints")
+	autoContinue := flags.Bool("continue", false, "Continue the module right away, so that it runs until a breakpoint is hit, instead of waiting for a client before its first instruction")
+	token := flags.String("token", "", "Token of the watcher, required from the clients (default $"+tokenEnv+")")
+	tokenFile := flags.String("token-file", "", "File of the authentication token of the watcher")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	binary, err := exec.LookPath(flags.Arg(0))
+	if err != nil {
+		log.Printf("Wrapper: %s\n", err)
+		return 127
+	}
+	var listenAt listenAddr
+	if len(*listenFlag) > 0 {
+		if listenAt, err = parseListen(*listenFlag); err != nil {
+			log.Printf("Wrapper: invalid -listen: %s\n", err)
+			return 2
+		}
+	}
+	// the proxy of the watcher authenticates to the Delve server of the wrapper with its token
+	if authToken, err = loadToken(*token, *tokenFile); err != nil {
+		log.Printf("Wrapper: couldn't load the authentication token: %s\n", err)
+		return 1
+	}
+
+	// launch the module under a Delve server listening on a private socket
+	os.Setenv(wrapperEnv, strconv.Itoa(os.Getpid()))
+	listener, err := listenBackend()
+	if err != nil {
+		log.Printf("Wrapper: couldn't listen for the Delve server: %s\n", err)
+		return 1
+	}
+	defer removeBackends()
+	server := rpccommon.NewServer(&service.Config{
+		Listener:    listener,
+		ProcessArgs: append([]string{binary}, flags.Args()[1:]...),
+		AcceptMulti: true,
+		AuthToken:   authToken,
+	}, true)
+	if err := server.Run(); err != nil {
+		log.Printf("Wrapper: couldn't launch %s: %s\n", binary, err)
+		return 1
+	}
+	d := server.Debugger()
+	id, err := currentIdentity(d.ProcessPid())
+	if err != nil {
+		log.Printf("Wrapper: the module process is gone: %s\n", err)
+		return 1
+	}
+	log.Printf("Wrapper: launched %s as %s, stopped before its first instruction\n", binary, id)
+
+	// the target of the watcher, or our own one
+	t := newTarget("", "", *port)
+	if status, err := registerWrapped(*watcher, *targetName, id.Pid, backendAddr(listener), authToken); err == nil {
+		t = newTarget(status.Key, status.Module, status.Port)
+		log.Printf("Wrapper: registered with the watcher at %s, debug the module on %s\n", *watcher, status.Listen)
+	} else {
+		log.Printf("Wrapper: %s, serving the module on its own\n", err)
+		if len(*listenFlag) > 0 {
+			t.setListen(listenAt)
+		}
+		public, err := listen(t.network(), t.addr())
+		if err != nil {
+			log.Printf("Wrapper: couldn't listen on %s: %s\n", t.addr(), err)
+			return 1
+		}
+		t.resolvePort(public)
+		proxy := newRPCProxy(public, 0, authToken)
+		defer proxy.Close()
+		proxy.setBackend(backendAddr(listener))
+		log.Printf("Wrapper: debug the module on %s\n", t.addr())
+	}
+
+	breakpoints := 0
+	if len(*initFile) > 0 {
+		if err := runInitFile(d, *initFile); err != nil {
+			log.Printf("Couldn't run init file %s: %s\n", *initFile, err)
+		}
+		for _, bp := range d.Breakpoints() {
+			if bp.ID > 0 {
+				breakpoints++
+			}
+		}
+	}
+	if *autoContinue || breakpoints > 0 {
+		go resumeProcess(t, d)
+	} else {
+		log.Printf("Wrapper: %s waits for a client to continue it\n", id)
+	}
+
+	exits := make(chan processExit)
+	done := make(chan bool)
+	defer close(done)
+	go watchExit(id, d, exits, done)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	code := 1
+	select {
+	case exit := <-exits:
+		if exit.status != nil {
+			code = *exit.status
+		}
+		log.Printf("Wrapper: %s exited with status %d\n", id, code)
+	case sig := <-signals:
+		// the process may be stopped by the debugger, it is killed
+		log.Printf("Wrapper: received %s, killing %s\n", sig, id)
+		syscall.Kill(id.Pid, syscall.SIGKILL)
+		select {
+		case <-exits:
+		case <-time.After(wrapExitTimeout):
+		}
+		code = 128 + int(sig.(syscall.Signal))
+	}
+	server.Stop(true)
+	return code
+}
+
+// registerWrapped registers the module process launched by the wrapper with
+// the watcher, with the token of the watcher if any. It returns the status of
+// the target debugging it.
+func registerWrapped(watcher string, target string, pid int, addr string, token string) (targetStatus, error) {
+	if len(watcher) == 0 {
+		return targetStatus{}, errors.New("no watcher to register with (-status-addr)")
+	}
+	form := url.Values{"pid": {strconv.Itoa(pid)}, "wrapper": {strconv.Itoa(os.Getpid())}, "addr": {addr}}
+	if len(target) > 0 {
+		form.Set("target", target)
+	}
+	req, err := http.NewRequest("POST", "http://"+watcher+"/wrap", strings.NewReader(form.Encode()))
+	if err != nil {
+		return targetStatus{}, fmt.Errorf("couldn't register with the watcher: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: registerTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return targetStatus{}, fmt.Errorf("couldn't register with the watcher: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return targetStatus{}, fmt.Errorf("the watcher refused the module process: %s", failure.Error)
+	}
+	var status targetStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return targetStatus{}, fmt.Errorf("invalid answer of the watcher: %s", err)
+	}
+	return status, nil
+}
+
+// wrap makes the Delve server of the wrapper, debugging the module process it
+// launched, the backend of the proxy. The process is released when it exits.
+func (t *target) wrap(id ProcessIdentity, addr string) error {
+	if t.proxy == nil {
+		return errors.New("the Delve servers are not proxied (-proxy=false)")
+	}
+	t.detach(reasonWrap)
+	log.Printf("Target %s: debugging %s, launched by the wrapper with its Delve server on %s\n", t, t.describe(id), addr)
+	t.wrapped = true
+	t.proxy.setBackend(addr)
+	t.exitDone = make(chan bool)
+	go watchExit(id, nil, t.exits, t.exitDone)
+	t.attachedExe, _ = processExePath(id.Pid)
+	t.fireHook(hookEvent{event: eventAttach, reason: reasonWrap, process: id, exe: t.attachedExe})
+
+	t.mu.Lock()
+	t.pending = ProcessIdentity{}
+	t.status.Detached = false
+	t.status.Wrapped = true
+	t.mu.Unlock()
+	t.setAttached(id)
+	return nil
+}
+
+// doWrap asks the run loop to debug the module process launched by the wrapper
+func (t *target) doWrap(id ProcessIdentity, addr string) error {
+	req := controlRequest{action: actionWrap, process: id, addr: addr, done: make(chan error)}
+	t.control <- req
+	return <-req.done
+}
+
+// wrapTarget returns the target of the module process launched by the
+// wrapper: the named one, or the one matching the process
+func (s *statusServer) wrapTarget(name string, p Process) (*target, error) {
+	if len(name) > 0 {
+		return s.findTarget(name)
+	}
+	info := identifyModule(p)
+	for _, t := range s.targets {
+		if t.matches(p, info) {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("PID %d is not a process of any target", p.Pid())
+}
+
+// isLocalBackend returns true if the address of the Delve server of the
+// wrapper is a Unix socket or on a loopback address
+func isLocalBackend(addr string) bool {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return filepath.IsAbs(strings.TrimPrefix(addr, unixPrefix))
+	}
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && net.ParseIP(host).IsLoopback()
+}
+
+// launchedBy checks that the module process was launched by the wrapper
+// registering it: the process has the PID of the wrapper in its environment
+// and is traced by the wrapper, or is its child where the tracer isn't known
+func launchedBy(p Process, wrapper int) error {
+	meta, err := processMetadata(p.Pid())
+	if err != nil {
+		return fmt.Errorf("couldn't read the environment of PID %d: %s", p.Pid(), err)
+	}
+	if meta.Environ[wrapperEnv] != strconv.Itoa(wrapper) {
+		return fmt.Errorf("PID %d was not launched by the wrapper %d ($%s is %q)", p.Pid(), wrapper, wrapperEnv, meta.Environ[wrapperEnv])
+	}
+	if tracerPidSupported {
+		if tracer := tracerPid(p.Pid()); tracer != wrapper {
+			return fmt.Errorf("PID %d is traced by PID %d, not by the wrapper %d", p.Pid(), tracer, wrapper)
+		}
+	} else if p.PPid() != wrapper {
+		return fmt.Errorf("PID %d is the child of PID %d, not of the wrapper %d", p.Pid(), p.PPid(), wrapper)
+	}
+	return nil
+}
+
+// handleWrap registers the module process launched by the wrapper, given by
+// the "pid" parameter, with the Delve server of the wrapper at "addr". The
+// wrapper gives its own PID in "wrapper".
+func (s *statusServer) handleWrap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed, use POST", r.Method))
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+	pid, err := strconv.Atoi(r.FormValue("pid"))
+	if err != nil || pid <= 0 {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("invalid pid %q", r.FormValue("pid")))
+		return
+	}
+	wrapper, err := strconv.Atoi(r.FormValue("wrapper"))
+	if err != nil || wrapper <= 0 {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("invalid wrapper pid %q", r.FormValue("wrapper")))
+		return
+	}
+	addr := r.FormValue("addr")
+	if !isLocalBackend(addr) {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("the Delve server of the wrapper must listen on a Unix socket or a loopback address, got %q", addr))
+		return
+	}
+	p, err := findProcess(pid)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("PID %d: %s", pid, err))
+		return
+	}
+	if err := launchedBy(p, wrapper); err != nil {
+		httpError(w, http.StatusForbidden, err)
+		return
+	}
+	t, err := s.wrapTarget(r.FormValue("target"), p)
+	if err != nil {
+		httpError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := t.doWrap(p.Identity(), addr); err != nil {
+		httpError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.Status())
+}
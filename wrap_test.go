@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRegisterWrapped(t *testing.T) {
+	var form url.Values
+	var auth string
+	watcher := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form, auth = r.PostForm, r.Header.Get("Authorization")
+		if r.FormValue("target") == "missing" {
+			httpError(w, http.StatusNotFound, os.ErrNotExist)
+			return
+		}
+		writeJSON(w, http.StatusOK, targetStatus{Key: "frontend", Port: 2345})
+	}))
+	defer watcher.Close()
+	host := strings.TrimPrefix(watcher.URL, "http://")
+
+	status, err := registerWrapped(host, "", 42, "unix:/tmp/delve.sock", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Key != "frontend" || status.Port != 2345 {
+		t.Errorf("status %+v", status)
+	}
+	if form.Get("pid") != "42" || form.Get("wrapper") != strconv.Itoa(os.Getpid()) || form.Get("addr") != "unix:/tmp/delve.sock" {
+		t.Errorf("registered %v", form)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("Authorization %q, want the token of the watcher", auth)
+	}
+
+	if _, err := registerWrapped(host, "", 42, "unix:/tmp/delve.sock", ""); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		t.Errorf("Authorization %q sent without token", auth)
+	}
+	if _, err := registerWrapped(host, "missing", 42, "unix:/tmp/delve.sock", ""); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("refused registration: %v", err)
+	}
+	if _, err := registerWrapped("", "", 42, "unix:/tmp/delve.sock", ""); err == nil {
+		t.Error("registration without watcher succeeded")
+	}
+}
+
+// startChild starts a process with the extra environment, it must be killed
+func startChild(t *testing.T, env ...string) *exec.Cmd {
+	cmd := exec.Command("sleep", "30")
+	cmd.Env = append(os.Environ(), env...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestHandleWrapRefused(t *testing.T) {
+	s := &statusServer{token: "secret"}
+	self := strconv.Itoa(os.Getpid())
+	stranger := startChild(t)
+	defer func() { stranger.Process.Kill(); stranger.Wait() }()
+	untraced := startChild(t, wrapperEnv+"="+self)
+	defer func() { untraced.Process.Kill(); untraced.Wait() }()
+
+	tests := []struct {
+		auth string
+		form url.Values
+		code int
+	}{
+		{"", url.Values{"pid": {"1"}, "wrapper": {self}, "addr": {"unix:/tmp/delve.sock"}}, http.StatusUnauthorized},
+		{"Bearer wrong", url.Values{"pid": {"1"}, "wrapper": {self}, "addr": {"unix:/tmp/delve.sock"}}, http.StatusUnauthorized},
+		{"Bearer secret", url.Values{"pid": {"1"}, "addr": {"unix:/tmp/delve.sock"}}, http.StatusBadRequest},
+		{"Bearer secret", url.Values{"pid": {"1"}, "wrapper": {self}, "addr": {"10.0.0.1:2345"}}, http.StatusBadRequest},
+		{"Bearer secret", url.Values{"pid": {"1"}, "wrapper": {self}, "addr": {"unix:delve.sock"}}, http.StatusBadRequest},
+		// not launched by the wrapper
+		{"Bearer secret", url.Values{"pid": {strconv.Itoa(stranger.Process.Pid)}, "wrapper": {self}, "addr": {"unix:/tmp/delve.sock"}}, http.StatusForbidden},
+	}
+	if tracerPidSupported {
+		// launched by the wrapper but not traced by it
+		tests = append(tests, struct {
+			auth string
+			form url.Values
+			code int
+		}{"Bearer secret", url.Values{"pid": {strconv.Itoa(untraced.Process.Pid)}, "wrapper": {self}, "addr": {"unix:/tmp/delve.sock"}}, http.StatusForbidden})
+	}
+	for i, test := range tests {
+		r, _ := http.NewRequest("POST", "/wrap", strings.NewReader(test.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(test.auth) > 0 {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		s.handleWrap(w, r)
+		if w.Code != test.code {
+			t.Errorf("test %d: status %d (%s), want %d", i, w.Code, strings.TrimSpace(w.Body.String()), test.code)
+		}
+	}
+}